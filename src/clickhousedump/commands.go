@@ -0,0 +1,814 @@
+package main
+
+import (
+	"context"
+	"fileutils"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"io/ioutil"
+	logs "logging"
+	"manifest"
+	"os"
+	parts "partutils"
+	"path"
+	"prune"
+	"restore"
+	"shadow"
+	"storage"
+	"strings"
+	"tarball"
+	"text/tabwriter"
+	"time"
+	"verify"
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(ctx context.Context, args []string) int
+}
+
+var commands = []command{
+	{"backup", "freeze partitions and copy them with metadata to backup", runBackup},
+	{"restore", "restore database from backup", runRestore},
+	{"list", "show backups in directory", runList},
+	{"info", "show backup contents", runInfo},
+	{"verify", "check backup files with manifest checksums and parts with checksums.txt", runVerify},
+	{"delete", "delete backup", runDelete},
+	{"prune", "delete backups outside retention policy", runPrune},
+	{"cleanup-stale", "delete shadow directories left by killed backups", runCleanupStale},
+	{"version", "show version", runVersion},
+}
+
+func runBackup(ctx context.Context, args []string) int {
+	var (
+		connection connectionOptions
+		storages   storageOptions
+		filters    filterOptions
+	)
+
+	flags := newFlagSet("backup", "[flags] -out <backup>", "Freeze partitions and copy them with metadata to backup directory or archive.")
+	connection.register(flags)
+	storages.register(flags)
+	filters.register(flags)
+	argDataBase := flags.String("db", "", "database name (all databases by default)")
+	argInDirectory := flags.String("in", "/var/lib/clickhouse", "clickhouse data directory")
+	argOutDirectory := flags.String("out", "", "destination directory or backup archive, - for stdout")
+	argArchive := flags.String("archive", "", "write backup to archive file -out with compression (none, gzip, zstd or lz4)")
+	argNoCleanUp := flags.Bool("no-cleanup", false, "do not delete freezed partitions hardlinks after backup")
+	argNoFreeze := flags.Bool("no-freeze", false, "do not freeze, only show partitions")
+	argIncrementalFrom := flags.String("incremental-from", "", "previous backup directory, unchanged parts are hardlinked from it")
+	argFreezeMode := flags.String("freeze-mode", parts.FreezeModeTable, "freeze whole tables (table) or every partition (partition)")
+	argParallel := flags.Int("parallel", 1, "number of tables frozen and copied concurrently")
+	argParallelPerDisk := flags.Int("parallel-per-disk", 0, "max number of tables copied concurrently from one disk (-parallel by default)")
+	argContinueOnError := flags.Bool("continue-on-error", false, "skip failed databases and tables and back up others (backup stops on first error by default)")
+	argSystemDatabases := flags.Bool("system-databases", false, "backup system and INFORMATION_SCHEMA databases too (skipped when -db is not set)")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+
+	inputDirectory := *argInDirectory
+	outputDirectory := *argOutDirectory
+	if outputDirectory == "" {
+		return usageError(flags, "please set destination directory")
+	}
+
+	// stdout is used for backup stream
+	if outputDirectory == "-" {
+		logs.Init(ioutil.Discard, os.Stderr, os.Stderr, os.Stderr)
+		if *argArchive == "" {
+			*argArchive = tarball.CompressionNone
+		}
+	}
+
+	logs.Info.Println("Run in backup mode")
+
+	remote, encryptionKey, closeRemote, err := storages.open()
+	if err != nil {
+		logs.Error.Println(err)
+		return exitFailure
+	}
+	defer closeRemote()
+
+	// archive is created in existing directory
+	outputParentDirectory := outputDirectory
+	if outputDirectory == "-" || remote != nil {
+		outputParentDirectory = inputDirectory
+	} else if *argArchive != "" {
+		outputParentDirectory = path.Dir(outputDirectory)
+	}
+
+	err, noDirectory := fileutils.IsDirectoryInListExist(inputDirectory, outputParentDirectory)
+	if err != nil {
+		logs.Error.Printf("%v not found", noDirectory)
+		return exitFailure
+	}
+
+	if *argIncrementalFrom != "" && (*argArchive != "" || remote != nil) {
+		return usageError(flags, "incremental backup is supported only for local directory")
+	}
+	if *argFreezeMode != parts.FreezeModeTable && *argFreezeMode != parts.FreezeModePartition {
+		return usageError(flags, "unknown freeze mode %v", *argFreezeMode)
+	}
+	if *argParallel < 1 || *argParallelPerDisk < 0 {
+		return usageError(flags, "-parallel must be positive and -parallel-per-disk must not be negative")
+	}
+	if *argIncrementalFrom != "" && encryptionKey != nil {
+		return usageError(flags, "incremental backup is not supported with encryption")
+	}
+	// files of failed tables can't be removed from archive stream
+	if *argContinueOnError && *argArchive != "" {
+		return usageError(flags, "-continue-on-error is not supported with archive output")
+	}
+
+	// make connection to clickhouse server
+	ClickhouseConnection, err := connection.connect()
+	if err != nil {
+		logs.Error.Printf("can't connect to clickouse server, %v", err)
+		return exitFailure
+	}
+	defer ClickhouseConnection.Close()
+
+	// nothing is written with -no-freeze, freeze queries are only shown
+	var (
+		destination      storage.Storage
+		closeDestination = func(error) error { return nil }
+	)
+	if !*argNoFreeze {
+		destination, closeDestination, err = openBackupDestination(outputDirectory, *argArchive, remote, encryptionKey)
+		if err != nil {
+			logs.Error.Printf("can't open backup destination, %v", err)
+			return exitFailure
+		}
+	}
+	backupRecorder := &storage.Recorder{Storage: destination}
+
+	var (
+		failures  parts.Failures
+		failedErr error
+	)
+
+	// get databases list for backup (all databases or -db argument)
+	var databases []DataBase
+	if *argDataBase == "" {
+		DatabaseList := GetDatabasesList{SystemFlag: *argSystemDatabases}
+		err = DatabaseList.Run(ctx, ClickhouseConnection)
+		if err != nil {
+			failedErr = fmt.Errorf("can't get database list, %v", err)
+		}
+		databases = DatabaseList.Result
+	} else {
+		databases = []DataBase{{Name: *argDataBase}}
+	}
+
+	ServerVersion := GetServerVersion{}
+	err = ServerVersion.Run(ctx, ClickhouseConnection)
+	if err != nil {
+		logs.Error.Printf("can't get server version, %v", err)
+	}
+	backupManifest := manifest.New(Version, BuildID, ServerVersion.Result)
+
+	if *argIncrementalFrom != "" {
+		previousManifest, err := manifest.Read(&storage.Local{Directory: *argIncrementalFrom})
+		if err != nil {
+			logs.Error.Printf("can't read manifest of previous backup, %v", err)
+			closeDestination(err)
+			return exitFailure
+		}
+		if previousManifest.Incomplete != "" {
+			logs.Error.Printf("previous backup is incomplete, %v", previousManifest.Incomplete)
+			closeDestination(fmt.Errorf("previous backup is incomplete"))
+			return exitFailure
+		}
+		logs.Info.Printf("incremental backup from %v", *argIncrementalFrom)
+		backupManifest.SetBase(*argIncrementalFrom, previousManifest)
+	}
+	// hardlinks of every run are created in own shadow directory
+	shadowName, err := shadow.NewName(time.Now())
+	if err != nil {
+		logs.Error.Printf("can't create shadow name, %v", err)
+		closeDestination(err)
+		return exitFailure
+	}
+	backupManifest.ShadowName = shadowName
+	var shadowLock *shadow.Lock
+	if !*argNoFreeze {
+		// lock is held while backup runs, cleanup-stale keeps locked directories
+		if shadowLock, err = shadow.CreateLocked(inputDirectory, shadowName); err != nil {
+			logs.Error.Printf("can't create shadow directory, %v", err)
+			closeDestination(err)
+			return exitFailure
+		}
+	}
+	if encryptionKey != nil {
+		logs.Info.Printf("encrypt backup with key %v", encryptionKey.ID)
+		backupManifest.SetEncryption(encryptionKey)
+	}
+
+	var (
+		tables     []parts.TableDescribe
+		partitions []parts.PartitionDescribe
+	)
+	for _, Database := range databases {
+		if failedErr != nil {
+			break
+		}
+
+		cmdGetTablesList := parts.GetTables{Database: Database.Name, Filter: filters.filter()}
+		cmdGetPartitionsList := parts.GetPartitions{Database: Database.Name, Filter: filters.filter()}
+		err = cmdGetTablesList.Run(ctx, ClickhouseConnection)
+		if err == nil {
+			err = cmdGetPartitionsList.Run(ctx, ClickhouseConnection)
+		}
+		if err != nil && *argContinueOnError && ctx.Err() == nil {
+			// database is skipped
+			failures.Add("database "+Database.Name, err)
+			continue
+		} else if err != nil {
+			failedErr = fmt.Errorf("database %v: %v", Database.Name, err)
+			break
+		}
+		backupManifest.AddTables(cmdGetTablesList.Result)
+		backupManifest.AddPartitions(cmdGetPartitionsList.Result)
+		tables = append(tables, cmdGetTablesList.Result...)
+		partitions = append(partitions, cmdGetPartitionsList.Result...)
+	}
+
+	// tables of all databases are frozen and copied by worker pool
+	cmdFreezePartitions := parts.FreezePartitions{
+		Mode:              *argFreezeMode,
+		ShadowName:        shadowName,
+		Tables:            tables,
+		Partitions:        partitions,
+		SourceDirectory:   inputDirectory,
+		Destination:       backupRecorder,
+		PreviousDirectory: *argIncrementalFrom,
+		NoFreezeFlag:      *argNoFreeze,
+		Filter:            filters.filter(),
+		Parallel:          *argParallel,
+		PerDiskParallel:   *argParallelPerDisk,
+		ContinueOnError:   *argContinueOnError,
+	}
+	if failedErr == nil {
+		failedErr = cmdFreezePartitions.Run(ctx, ClickhouseConnection)
+		backupManifest.AddFreezeTimes(cmdFreezePartitions.Result)
+		for _, failure := range cmdFreezePartitions.Failed.List {
+			failures.Add(failure.Object, failure.Err)
+		}
+	}
+	for _, failure := range failures.List {
+		backupManifest.Failures = append(backupManifest.Failures, fmt.Sprintf("%v: %v", failure.Object, failure.Err))
+	}
+	if ctx.Err() != nil {
+		// copied files are kept, manifest marks backup as incomplete
+		logs.Warning.Printf("backup is interrupted")
+		backupManifest.Incomplete = "interrupted"
+		failedErr = ctx.Err()
+	} else if failedErr != nil {
+		logs.Error.Printf("backup is stopped, %v", failedErr)
+		backupManifest.Incomplete = failedErr.Error()
+	}
+	status := exitOK
+	if failedErr != nil {
+		status = exitFailure
+	}
+
+	// write backup manifest, backup is complete when manifest exists
+	if !*argNoFreeze {
+		backupManifest.CollectFiles(backupRecorder)
+		backupManifest.EndTime = time.Now()
+		logs.Info.Printf("write manifest to %v", outputDirectory)
+		err = backupManifest.Write(destination)
+		if err != nil {
+			logs.Error.Printf("can't write manifest, %v", err)
+			status = exitFailure
+			failedErr = err
+		}
+	}
+	// archive of failed backup is discarded, backup directory is kept with incomplete manifest
+	if err = closeDestination(failedErr); err != nil {
+		logs.Error.Printf("can't write backup, %v", err)
+		status = exitFailure
+	}
+
+	// clean up shadow directory of this run only
+	if !*argNoCleanUp {
+		logs.Info.Printf("clean up %v", inputDirectory+"/shadow/"+shadowName)
+		if err = os.RemoveAll(inputDirectory + "/shadow/" + shadowName); err != nil {
+			logs.Error.Printf("can't clean up shadow directory, %v", err)
+			status = exitFailure
+		}
+	}
+	if shadowLock != nil {
+		shadowLock.Unlock()
+	}
+
+	return reportFailures(failures.List, status)
+}
+
+// Show failed objects at the end of command, any failure makes command failed
+func reportFailures(failures []parts.Failure, status int) int {
+	if len(failures) == 0 {
+		return status
+	}
+
+	logs.Error.Printf("%v objects failed:", len(failures))
+	for _, failure := range failures {
+		logs.Error.Printf("  %v: %v", failure.Object, failure.Err)
+	}
+	return exitFailure
+}
+
+// Write restore plan of dry run to file or stdout
+func writePlan(plan restore.Plan, fileName string, status int) int {
+	if fileName == "" {
+		if err := plan.Write(os.Stdout); err != nil {
+			logs.Error.Printf("can't write restore plan, %v", err)
+			return exitFailure
+		}
+		return status
+	}
+
+	file, err := os.Create(fileName)
+	if err == nil {
+		err = plan.Write(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logs.Error.Printf("can't write restore plan, %v", err)
+		return exitFailure
+	}
+	logs.Info.Printf("restore plan is written to %v", fileName)
+	return status
+}
+
+func runRestore(ctx context.Context, args []string) int {
+	var (
+		connection connectionOptions
+		storages   storageOptions
+		filters    filterOptions
+	)
+
+	flags := newFlagSet("restore", "[flags] -db <database> -in <backup>", "Restore database from backup directory or archive.")
+	connection.register(flags)
+	storages.register(flags)
+	filters.register(flags)
+	argDataBase := flags.String("db", "", "database name")
+	argRestoreAs := flags.String("restore-as", "", "restore database under new name (backup name by default)")
+	argInDirectory := flags.String("in", "", "backup directory or archive, - for stdin")
+	argOutDirectory := flags.String("out", "/var/lib/clickhouse", "clickhouse data directory")
+	argContinueOnError := flags.Bool("continue-on-error", false, "skip failed tables and restore others (restore stops on first error by default)")
+	argTable := flags.String("table", "", "restore only parts of -partitions into existing table, schema is not changed")
+	var argPartitions patternList
+	flags.Var(&argPartitions, "partitions", "partition ID or glob pattern restored with -table (for example 202001,2021*), repeatable")
+	argPartitionsFrom := flags.String("partitions-from", "", "first partition ID restored with -table")
+	argPartitionsTo := flags.String("partitions-to", "", "last partition ID restored with -table")
+	argConflict := flags.String("on-conflict", "", "restore into existing database, policy for existing tables: "+strings.Join(restore.ConflictPolicies, ", "))
+	argDryRun := flags.Bool("dry-run", false, "do not change server and do not copy files, only show restore statements")
+	argPlanFile := flags.String("plan-file", "", "write restore statements of -dry-run to .sql file (stdout by default)")
+	argCheckExisting := flags.Bool("dry-run-check-existing", false, "connect to server in -dry-run to read existing tables of -on-conflict policy (dry run does not connect by default)")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+
+	inputDirectory := *argInDirectory
+	outputDirectory := *argOutDirectory
+	if inputDirectory == "" {
+		return usageError(flags, "please set source directory")
+	}
+	if *argDataBase == "" {
+		return usageError(flags, "please set database for restore")
+	}
+	if *argConflict != "" && !restore.IsConflictPolicy(*argConflict) {
+		return usageError(flags, "unknown conflict policy %v", *argConflict)
+	}
+	partitionFilter := parts.PartitionFilter{IDs: argPartitions, From: *argPartitionsFrom, To: *argPartitionsTo}
+	if (*argTable == "") != partitionFilter.IsEmpty() {
+		return usageError(flags, "-table must be set with -partitions, -partitions-from or -partitions-to")
+	}
+
+	if *argPlanFile != "" && !*argDryRun {
+		return usageError(flags, "-plan-file is used only with -dry-run")
+	}
+	if *argCheckExisting && (!*argDryRun || *argConflict == "") {
+		return usageError(flags, "-dry-run-check-existing is used only with -dry-run and -on-conflict")
+	}
+
+	// stdout is used for restore plan
+	if *argDryRun && *argPlanFile == "" {
+		logs.Init(ioutil.Discard, os.Stderr, os.Stderr, os.Stderr)
+	}
+
+	logs.Info.Println("Run in restore mode")
+
+	remote, encryptionKey, closeRemote, err := storages.open()
+	if err != nil {
+		logs.Error.Println(err)
+		return exitFailure
+	}
+	defer closeRemote()
+
+	inputParentDirectory := inputDirectory
+	if inputDirectory == "-" || remote != nil {
+		inputParentDirectory = outputDirectory
+	}
+
+	// dry run does not use clickhouse data directory and connects to server
+	// only when it is allowed to read existing tables for conflict policy
+	var ClickhouseConnection *sqlx.DB
+	extractDirectory := ""
+	if !*argDryRun {
+		err, noDirectory := fileutils.IsDirectoryInListExist(inputParentDirectory, outputDirectory)
+		if err != nil {
+			logs.Error.Printf("%v not found", noDirectory)
+			return exitFailure
+		}
+		extractDirectory = outputDirectory
+	}
+	if !*argDryRun || *argCheckExisting {
+		// make connection to clickhouse server
+		ClickhouseConnection, err = connection.connect()
+		if err != nil {
+			logs.Error.Printf("can't connect to clickouse server, %v", err)
+			return exitFailure
+		}
+		defer ClickhouseConnection.Close()
+	}
+
+	// backup archives and stdin stream are extracted to temporary directory, dry run reads only metadata in memory
+	source, temporaryDirectory, err := openBackupSource(ctx, inputDirectory, *argDataBase, extractDirectory, *argDryRun, remote, encryptionKey)
+	if err != nil {
+		logs.Error.Printf("can't open backup, %v", err)
+		return exitFailure
+	}
+	if temporaryDirectory != "" {
+		defer func() {
+			logs.Info.Printf("clean up %v", temporaryDirectory)
+			os.RemoveAll(temporaryDirectory)
+		}()
+	}
+	if err = checkBackupEncryption(source, encryptionKey); err != nil {
+		logs.Error.Printf("can't open backup, %v", err)
+		return exitFailure
+	}
+	backupManifest, err := readCompleteManifest(source)
+	if err != nil {
+		logs.Error.Printf("can't restore backup, %v", err)
+		return exitFailure
+	}
+
+	if *argTable != "" {
+		cmdRestorePartitions := restore.RestorePartitions{
+			DatabaseName:         *argDataBase,
+			TargetDatabaseName:   *argRestoreAs,
+			TableName:            *argTable,
+			Source:               source,
+			DestinationDirectory: outputDirectory,
+			MoveFlag:             temporaryDirectory != "",
+			Partitions:           partitionFilter,
+			Plan:                 restore.Plan{DryRunFlag: *argDryRun},
+		}
+		if err = cmdRestorePartitions.Run(ctx, ClickhouseConnection); err != nil {
+			logs.Error.Printf("can't restore partitions, %v", err)
+			return exitFailure
+		}
+		if *argDryRun {
+			return writePlan(cmdRestorePartitions.Plan, *argPlanFile, exitOK)
+		}
+		logs.Info.Printf("%v parts restored", len(cmdRestorePartitions.Result))
+		return exitOK
+	}
+
+	cmdRestoreDatabase := restore.RestoreDatabase{
+		DatabaseName:         *argDataBase,
+		TargetDatabaseName:   *argRestoreAs,
+		Source:               source,
+		DestinationDirectory: outputDirectory,
+		MoveFlag:             temporaryDirectory != "",
+		Filter:               filters.filter(),
+		ContinueOnError:      *argContinueOnError,
+		Manifest:             backupManifest,
+		Conflict:             *argConflict,
+		Plan:                 restore.Plan{DryRunFlag: *argDryRun, CheckExistingFlag: *argCheckExisting},
+	}
+	status := exitOK
+	err = cmdRestoreDatabase.Run(ctx, ClickhouseConnection)
+	if err != nil {
+		logs.Error.Printf("can't restore database, %v", err)
+		status = exitFailure
+	}
+	if *argDryRun {
+		status = writePlan(cmdRestoreDatabase.Plan, *argPlanFile, status)
+	}
+
+	return reportFailures(cmdRestoreDatabase.Failed.List, status)
+}
+
+func runList(ctx context.Context, args []string) int {
+	var storages storageOptions
+
+	flags := newFlagSet("list", "[flags] -dir <directory>", "Show backups in directory, backups without manifest are shown as incomplete, only files with archive extension (.tar, .tgz, .tar.gz, .tar.zst, .tar.lz4, with .enc for encrypted) are archives.")
+	storages.register(flags)
+	argDirectory := flags.String("dir", "", "directory with backups (relative to -s3-prefix or -sftp-directory for remote storage)")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+
+	remote, _, closeRemote, err := storages.open()
+	if err != nil {
+		logs.Error.Println(err)
+		return exitFailure
+	}
+	defer closeRemote()
+
+	if *argDirectory == "" && remote == nil {
+		return usageError(flags, "please set backups directory")
+	}
+	backupsStorage := openDirectory(remote, *argDirectory)
+
+	backups, err := manifest.ListBackups(backupsStorage)
+	if err != nil {
+		logs.Error.Printf("can't list backups, %v", err)
+		return exitFailure
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tTYPE\tSTARTED\tDURATION\tSIZE\tINCREMENTAL FROM\tENCRYPTION KEY")
+	for _, backup := range backups {
+		// archives and incomplete backups have no manifest
+		if backup.Archive {
+			fmt.Fprintf(writer, "%v\tarchive\t%v\t\t%v\t\t\n", backup.Name, backup.ModTime.Format(time.RFC3339), backup.Size)
+			continue
+		}
+		if backup.Manifest == nil {
+			fmt.Fprintf(writer, "%v\tincomplete\t\t\t\t\t\n", backup.Name)
+			continue
+		}
+
+		encryptionKeyID := ""
+		if backup.Manifest.Encryption != nil {
+			encryptionKeyID = backup.Manifest.Encryption.KeyID
+		}
+		backupType := "backup"
+		if backup.Manifest.Incomplete != "" {
+			backupType = "incomplete"
+		} else if len(backup.Manifest.Failures) > 0 {
+			backupType = "partial"
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			backup.Name,
+			backupType,
+			backup.Manifest.StartTime.Format(time.RFC3339),
+			backup.Manifest.EndTime.Sub(backup.Manifest.StartTime).Round(time.Second),
+			backup.Manifest.Size(),
+			backup.Manifest.IncrementalFrom,
+			encryptionKeyID)
+	}
+
+	writer.Flush()
+	return exitOK
+}
+
+func runInfo(ctx context.Context, args []string) int {
+	var storages storageOptions
+
+	flags := newFlagSet("info", "[flags] -in <backup>", "Show backup databases, tables and parts from manifest.")
+	storages.register(flags)
+	argInDirectory := flags.String("in", "", "backup directory")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+	if *argInDirectory == "" {
+		return usageError(flags, "please set backup directory")
+	}
+
+	remote, encryptionKey, closeRemote, err := storages.open()
+	if err != nil {
+		logs.Error.Println(err)
+		return exitFailure
+	}
+	defer closeRemote()
+
+	// databases of encrypted backup are shown only with encryption key
+	backupStorage := openDirectory(remote, *argInDirectory)
+	backupManifest, err := manifest.ReadHeader(backupStorage)
+	if err == nil && backupManifest.Encryption != nil && encryptionKey != nil {
+		if err = backupManifest.CheckEncryption(encryptionKey); err == nil {
+			backupManifest, err = manifest.Read(encryptedStorage(backupStorage, encryptionKey))
+		}
+	}
+	if err != nil {
+		logs.Error.Printf("can't read manifest, %v", err)
+		return exitFailure
+	}
+
+	fmt.Printf("Started:        %v\n", backupManifest.StartTime.Format(time.RFC3339))
+	fmt.Printf("Finished:       %v\n", backupManifest.EndTime.Format(time.RFC3339))
+	fmt.Printf("Tool version:   %v (%v)\n", backupManifest.ToolVersion, backupManifest.BuildID)
+	fmt.Printf("Server version: %v\n", backupManifest.ServerVersion)
+	fmt.Printf("Size:           %v\n", backupManifest.Size())
+	if backupManifest.Incomplete != "" {
+		fmt.Printf("Incomplete:     %v\n", backupManifest.Incomplete)
+	}
+	for _, failure := range backupManifest.Failures {
+		fmt.Printf("Failed:         %v\n", failure)
+	}
+	if backupManifest.IncrementalFrom != "" {
+		fmt.Printf("Incremental:    from %v\n", backupManifest.IncrementalFrom)
+	}
+	if backupManifest.Encryption != nil {
+		fmt.Printf("Encryption:     %v, key %v\n", backupManifest.Encryption.Algorithm, backupManifest.Encryption.KeyID)
+		if encryptionKey == nil {
+			fmt.Println("\nDatabases are encrypted, set encryption key to show them")
+			return exitOK
+		}
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "\nDATABASE\tTABLE\tENGINE\tFROZEN\tPARTITIONS\tPARTS")
+	for _, database := range backupManifest.Databases {
+		for _, table := range database.Tables {
+			frozen := "-"
+			if table.FreezeTime != nil {
+				frozen = table.FreezeTime.Format(time.RFC3339)
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n",
+				database.Name,
+				table.Name,
+				table.Engine,
+				frozen,
+				len(table.Partitions),
+				len(table.Parts))
+		}
+	}
+	writer.Flush()
+
+	return exitOK
+}
+
+func runVerify(ctx context.Context, args []string) int {
+	var storages storageOptions
+
+	flags := newFlagSet("verify", "[flags] -in <backup>", "Check backup files with manifest checksums and parts with checksums.txt.")
+	storages.register(flags)
+	argInDirectory := flags.String("in", "", "backup directory")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+	if *argInDirectory == "" {
+		return usageError(flags, "please set backup directory")
+	}
+
+	logs.Info.Println("Run in verify mode")
+
+	remote, encryptionKey, closeRemote, err := storages.open()
+	if err != nil {
+		logs.Error.Println(err)
+		return exitFailure
+	}
+	defer closeRemote()
+
+	backupStorage := openDirectory(remote, *argInDirectory)
+	if err = checkBackupEncryption(backupStorage, encryptionKey); err != nil {
+		logs.Error.Printf("can't verify backup, %v", err)
+		return exitFailure
+	}
+
+	cmdVerifyBackup := verify.VerifyBackup{Source: encryptedStorage(backupStorage, encryptionKey)}
+	err = cmdVerifyBackup.Run(ctx)
+	if err != nil {
+		logs.Error.Printf("can't verify backup, %v", err)
+		return exitFailure
+	}
+	if len(cmdVerifyBackup.Result) > 0 {
+		logs.Error.Printf("backup is broken, %v problems found", len(cmdVerifyBackup.Result))
+		return exitFailure
+	}
+
+	logs.Info.Println("backup is ok")
+	return exitOK
+}
+
+func runDelete(ctx context.Context, args []string) int {
+	var storages storageOptions
+
+	flags := newFlagSet("delete", "[flags] -in <backup>", "Delete backup directory or archive, bases of incremental backups are deleted only with -force.")
+	storages.register(flags)
+	argInDirectory := flags.String("in", "", "backup directory or archive")
+	argForce := flags.Bool("force", false, "delete backup used as base of incremental backups")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+	if *argInDirectory == "" {
+		return usageError(flags, "please set backup directory")
+	}
+
+	remote, _, closeRemote, err := storages.open()
+	if err != nil {
+		logs.Error.Println(err)
+		return exitFailure
+	}
+	defer closeRemote()
+
+	cmdDeleteBackup := prune.DeleteBackup{
+		Destination: openDirectory(remote, path.Dir(*argInDirectory)),
+		Name:        path.Base(*argInDirectory),
+		Force:       *argForce,
+	}
+	if err = cmdDeleteBackup.Run(ctx); err != nil {
+		logs.Error.Printf("can't delete backup, %v", err)
+		return exitFailure
+	}
+
+	return exitOK
+}
+
+func runPrune(ctx context.Context, args []string) int {
+	var storages storageOptions
+
+	flags := newFlagSet("prune", "[flags] -dir <directory> -keep-*", "Delete backups outside retention policy, bases of kept incremental backups are kept.")
+	storages.register(flags)
+	argDirectory := flags.String("dir", "", "directory with backups (relative to -s3-prefix or -sftp-directory for remote storage)")
+	argKeepLast := flags.Int("keep-last", 0, "keep N latest backups")
+	argKeepDaily := flags.Int("keep-daily", 0, "keep latest backup of every day for N days")
+	argKeepWeekly := flags.Int("keep-weekly", 0, "keep latest backup of every week for N weeks")
+	argKeepMonthly := flags.Int("keep-monthly", 0, "keep latest backup of every month for N months")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+	if *argKeepLast <= 0 && *argKeepDaily <= 0 && *argKeepWeekly <= 0 && *argKeepMonthly <= 0 {
+		return usageError(flags, "please set retention policy (-keep-last, -keep-daily, -keep-weekly or -keep-monthly)")
+	}
+
+	logs.Info.Println("Run in prune mode")
+
+	remote, _, closeRemote, err := storages.open()
+	if err != nil {
+		logs.Error.Println(err)
+		return exitFailure
+	}
+	defer closeRemote()
+
+	if *argDirectory == "" && remote == nil {
+		return usageError(flags, "please set backups directory")
+	}
+
+	cmdPruneBackups := prune.PruneBackups{
+		Destination: openDirectory(remote, *argDirectory),
+		Policy: prune.Policy{
+			KeepLast:    *argKeepLast,
+			KeepDaily:   *argKeepDaily,
+			KeepWeekly:  *argKeepWeekly,
+			KeepMonthly: *argKeepMonthly,
+		},
+		Now: time.Now(),
+	}
+	err = cmdPruneBackups.Run(ctx)
+	if err != nil {
+		logs.Error.Printf("can't prune backups, %v", err)
+		return exitFailure
+	}
+
+	logs.Info.Printf("%v backups deleted", len(cmdPruneBackups.Result))
+	return exitOK
+}
+
+func runCleanupStale(ctx context.Context, args []string) int {
+	flags := newFlagSet("cleanup-stale", "[flags]", "Delete shadow directories which are not locked by running backup.")
+	argInDirectory := flags.String("in", "/var/lib/clickhouse", "clickhouse data directory")
+	argMinAge := flags.Duration("min-age", time.Hour, "delete only directories older than this")
+	argDryRun := flags.Bool("dry-run", false, "only show stale directories")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+
+	logs.Info.Println("Run in cleanup-stale mode")
+
+	cmdCleanupStale := shadow.CleanupStale{
+		SourceDirectory: *argInDirectory,
+		MinAge:          *argMinAge,
+		Now:             time.Now(),
+		DryRunFlag:      *argDryRun,
+	}
+	err := cmdCleanupStale.Run(ctx)
+	if err != nil {
+		logs.Error.Printf("can't clean up shadow directories, %v", err)
+		return exitFailure
+	}
+
+	logs.Info.Printf("%v stale shadow directories found", len(cmdCleanupStale.Result))
+	return exitOK
+}
+
+func runVersion(ctx context.Context, args []string) int {
+	flags := newFlagSet("version", "", "Show version.")
+	if status, done := parseFlags(flags, args); done {
+		return status
+	}
+
+	fmt.Printf("version: %s\n", Version)
+	fmt.Printf("build info: %s at %s\n", BuildID, BuildDate)
+	return exitOK
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Configuration file is used when exists, CLICKHOUSEDUMP_CONFIG environment variable overrides it
+const defaultConfigFile = "/etc/clickhousedump/config.yaml"
+
+// Prefix of environment variables with settings, for example CLICKHOUSEDUMP_S3_BUCKET
+const envPrefix = "CLICKHOUSEDUMP_"
+
+// Setting names for flags with short names
+var settingNames = map[string]string{
+	"h":   "host",
+	"p":   "port",
+	"d":   "debug",
+	"db":  "database",
+	"in":  "input",
+	"out": "output",
+}
+
+// Flags with opposite meaning in commands, as input of backup is data directory and input of restore
+// is backup, they are set in command sections only: backup: {output: ...} or CLICKHOUSEDUMP_BACKUP_OUTPUT
+var commandSettings = []string{"in", "out"}
+
+// Flags with values hidden in printed configuration
+var secretSettings = []string{"secret-key", "password"}
+
+// Get setting name of flag
+func settingName(flagName string) string {
+	if name, ok := settingNames[flagName]; ok {
+		return name
+	}
+	return flagName
+}
+
+// Get setting name of command flag in configuration file and environment, command settings are prefixed with command name
+func commandSettingName(command string, flagName string) string {
+	for _, name := range commandSettings {
+		if name == flagName {
+			return command + "-" + settingName(flagName)
+		}
+	}
+	return settingName(flagName)
+}
+
+// Get flag name of setting, config keys may use nested sections and underscores
+func flagName(setting string) string {
+	setting = strings.Replace(strings.ToLower(setting), "_", "-", -1)
+	for flagName, name := range settingNames {
+		if name == setting {
+			return flagName
+		}
+	}
+	return setting
+}
+
+// Read settings from YAML or TOML (by extension) configuration file
+func readConfig(fileName string) (map[string]string, error) {
+	var config map[string]interface{}
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if path.Ext(fileName) == ".toml" {
+		err = toml.Unmarshal(content, &config)
+	} else {
+		var yamlConfig map[interface{}]interface{}
+		err = yaml.Unmarshal(content, &yamlConfig)
+		config = make(map[string]interface{})
+		for key, value := range yamlConfig {
+			config[fmt.Sprint(key)] = value
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %v, %v", fileName, err)
+	}
+
+	result := make(map[string]string)
+	flattenConfig(config, "", result)
+	return result, nil
+}
+
+// Join nested sections to flag names, s3: {bucket: x} is s3-bucket
+func flattenConfig(config map[string]interface{}, prefix string, result map[string]string) {
+	for key, value := range config {
+		name := flagName(prefix + key)
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(value, name+"-", result)
+		case map[interface{}]interface{}:
+			section := make(map[string]interface{})
+			for sectionKey, sectionValue := range value {
+				section[fmt.Sprint(sectionKey)] = sectionValue
+			}
+			flattenConfig(section, name+"-", result)
+		case nil:
+		case []interface{}:
+			var values []string
+			for _, item := range value {
+				values = append(values, fmt.Sprint(item))
+			}
+			result[name] = strings.Join(values, ",")
+		default:
+			result[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// Set flags not passed in command line from environment variables and configuration file
+func applyConfig(flags *flag.FlagSet) (map[string]string, error) {
+	sources := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+
+	var err error
+	configFile := flags.Lookup("config").Value.String()
+	if sources["config"] == "" {
+		if value, ok := os.LookupEnv(envPrefix + "CONFIG"); ok {
+			configFile = value
+			sources["config"] = "env " + envPrefix + "CONFIG"
+		}
+	}
+
+	// empty name disables configuration file
+	config := make(map[string]string)
+	if configFile != "" {
+		config, err = readConfig(configFile)
+	}
+	if err != nil {
+		// default configuration file is optional
+		if !os.IsNotExist(err) || sources["config"] != "" {
+			return nil, err
+		}
+		config = make(map[string]string)
+		configFile = ""
+		sources["config"] = "default, not found"
+	}
+
+	for _, name := range commandSettings {
+		if _, ok := config[name]; ok {
+			return nil, fmt.Errorf("%v in %v is set per command, for example %v", settingName(name), configFile, commandSettingName("backup", name))
+		}
+	}
+
+	var setErr error
+	flags.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != "" || setErr != nil || f.Name == "print-config" {
+			return
+		}
+		setting := commandSettingName(flags.Name(), f.Name)
+		envName := envPrefix + strings.ToUpper(strings.Replace(setting, "-", "_", -1))
+		if value, ok := os.LookupEnv(envName); ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value %q of %v, %v", value, envName, err)
+			}
+			sources[f.Name] = "env " + envName
+		} else if value, ok := config[flagName(setting)]; ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value %q of %v in %v, %v", value, setting, configFile, err)
+			}
+			sources[f.Name] = configFile
+		}
+	})
+	if setErr != nil {
+		return nil, setErr
+	}
+	if configFile != "" {
+		flags.Set("config", configFile)
+	}
+
+	return sources, nil
+}
+
+// Print effective settings with their sources in configuration file format
+func printConfig(flags *flag.FlagSet, sources map[string]string) {
+	var lines []string
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "print-config" {
+			return
+		}
+		value := f.Value.String()
+		for _, secret := range secretSettings {
+			if strings.HasSuffix(f.Name, secret) && value != "" {
+				value = "******"
+			}
+		}
+		source := sources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		lines = append(lines, fmt.Sprintf("%v: %v # %v", commandSettingName(flags.Name(), f.Name), strconv.Quote(value), source))
+	})
+
+	sort.Strings(lines)
+	fmt.Println(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Write configuration file to temporary directory
+func testConfig(t *testing.T, name string, content string) string {
+	directory, err := ioutil.TempDir("", "config_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(directory+"/"+name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return directory + "/" + name
+}
+
+func TestReadConfig(t *testing.T) {
+	for name, content := range map[string]string{
+		"config.yaml": "host: clickhouse-1\nbackup:\n  output: /backups/daily\ns3:\n  secret_key: key\ninclude: [a.*, b.*]\n",
+		"config.toml": "host = \"clickhouse-1\"\ninclude = [\"a.*\", \"b.*\"]\n[backup]\noutput = \"/backups/daily\"\n[s3]\nsecret_key = \"key\"\n",
+	} {
+		fileName := testConfig(t, name, content)
+		defer os.RemoveAll(path.Dir(fileName))
+
+		config, err := readConfig(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"h": "clickhouse-1", "backup-output": "/backups/daily", "s3-secret-key": "key", "include": "a.*,b.*"}
+		if len(config) != len(expected) {
+			t.Errorf("%v: got %v, expected %v", name, config, expected)
+		}
+		for key, value := range expected {
+			if config[key] != value {
+				t.Errorf("%v: got %v %q, expected %q", name, key, config[key], value)
+			}
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	fileName := testConfig(t, "config.yaml", "host: clickhouse-1\nbackup:\n  output: /backups/daily\nrestore:\n  input: /backups/weekly\n")
+	defer os.RemoveAll(path.Dir(fileName))
+	os.Setenv(envPrefix+"RESTORE_OUTPUT", "/data")
+	defer os.Unsetenv(envPrefix + "RESTORE_OUTPUT")
+
+	tests := []struct {
+		command string
+		args    []string
+		in      string
+		out     string
+		host    string
+	}{
+		{"backup", nil, "/var/lib/clickhouse", "/backups/daily", "clickhouse-1"},
+		{"backup", []string{"-out", "/backups/hourly", "-h", "localhost"}, "/var/lib/clickhouse", "/backups/hourly", "localhost"},
+		{"restore", nil, "/backups/weekly", "/data", "clickhouse-1"},
+	}
+
+	for _, test := range tests {
+		flags := newFlagSet(test.command, "", "")
+		flags.String("h", "", "")
+		flags.String("in", "/var/lib/clickhouse", "")
+		flags.String("out", "", "")
+		flags.Parse(append([]string{"-config", fileName}, test.args...))
+
+		if _, err := applyConfig(flags); err != nil {
+			t.Fatal(err)
+		}
+		in, out, host := flags.Lookup("in").Value.String(), flags.Lookup("out").Value.String(), flags.Lookup("h").Value.String()
+		if in != test.in || out != test.out || host != test.host {
+			t.Errorf("%v %v: got %v, %v, %v, expected %v, %v, %v", test.command, test.args, in, out, host, test.in, test.out, test.host)
+		}
+	}
+}
+
+func TestApplyConfigCommandSettings(t *testing.T) {
+	fileName := testConfig(t, "config.yaml", "output: /backups/daily\n")
+	defer os.RemoveAll(path.Dir(fileName))
+
+	flags := newFlagSet("backup", "", "")
+	flags.String("out", "", "")
+	flags.Parse([]string{"-config", fileName})
+	if _, err := applyConfig(flags); err == nil {
+		t.Errorf("got no error for output setting without command section")
+	}
+}
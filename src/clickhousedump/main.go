@@ -1,16 +1,14 @@
 package main
 
 import (
-	"fileutils"
-	"flag"
+	"context"
 	"fmt"
 	"github.com/jmoiron/sqlx"
-	"github.com/kshvakov/clickhouse"
 	"io/ioutil"
 	logs "logging"
 	"os"
-	parts "partutils"
-	"restore"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -21,15 +19,29 @@ var (
 )
 
 type GetDatabasesList struct {
-	Result []DataBase
+	SystemFlag bool
+	Result     []DataBase
 }
 
+// Databases with server tables, skipped unless SystemFlag is set
+var systemDatabases = []string{"system", "INFORMATION_SCHEMA", "information_schema"}
+
 type DataBase struct {
 	Name string
 }
 
-// Get databases list from server
-func (gd *GetDatabasesList) Run(databaseConnection *sqlx.DB) error {
+// Check database is system database
+func isSystemDatabase(name string) bool {
+	for _, systemName := range systemDatabases {
+		if name == systemName {
+			return true
+		}
+	}
+	return false
+}
+
+// Get databases list from server, system databases are skipped by default
+func (gd *GetDatabasesList) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
 
 	var (
 		err       error
@@ -38,12 +50,16 @@ func (gd *GetDatabasesList) Run(databaseConnection *sqlx.DB) error {
 		}
 	)
 
-	err = databaseConnection.Select(&databases, "show databases;")
+	err = databaseConnection.SelectContext(ctx, &databases, "show databases;")
 	if err != nil {
 		return err
 	}
 
 	for _, item := range databases {
+		if !gd.SystemFlag && isSystemDatabase(item.DatabaseName) {
+			logs.Info.Printf("skip system database %v", item.DatabaseName)
+			continue
+		}
 		gd.Result = append(gd.Result, DataBase{
 			Name: item.DatabaseName,
 		})
@@ -53,166 +69,69 @@ func (gd *GetDatabasesList) Run(databaseConnection *sqlx.DB) error {
 
 }
 
-func main() {
-
-	var (
-		err             error
-		inputDirectory  string
-		outputDirectory string
-	)
+type GetServerVersion struct {
+	Result string
+}
 
-	logs.Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
+// Get clickhouse server version
+func (gv *GetServerVersion) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
+	return databaseConnection.GetContext(ctx, &gv.Result, "select version();")
+}
 
-	argBackup := flag.Bool("backup", false, "backup mode")
-	argRestore := flag.Bool("restore", false, "restore mode")
-	argHost := flag.String("h", "127.0.0.1", "server hostname")
-	argDataBase := flag.String("db", "", "database name")
-	argVersion := flag.Bool("version", false, "show version")
-	argNoCleanUp := flag.Bool("no-cleanup", false, "do not delete freezed partitions hardlinks after backup")
-	argDebugOn := flag.Bool("d", false, "show debug info")
-	argPort := flag.String("p", "9000", "server port")
-	argNoFreeze := flag.Bool("no-freeze", false, "do not freeze, only show partitions")
-	argInDirectory := flag.String("in", "", "source directory (/var/lib/clickhouse for backup mode by default)")
-	argOutDirectory := flag.String("out", "", "destination directory")
-
-	flag.Parse()
-
-	ClickhouseConnectionString = "tcp://" + *argHost + ":" + *argPort + "?username=&compress=true"
-
-	if *argVersion {
-		logs.Info.Printf("version: %s", Version)
-		logs.Info.Printf("build info: %s at %s", BuildID, BuildDate)
-		os.Exit(0)
+// Show commands list
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: clickhousedump <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-15v%v\n", cmd.name, cmd.description)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun clickhousedump help <command> for command flags.\n")
+}
 
-	if *argDebugOn {
-		ClickhouseConnectionString = ClickhouseConnectionString + "&debug=true"
-	}
+// Cancel context on SIGINT or SIGTERM to stop command cleanly, second signal terminates immediately
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		received := <-signals
+		logs.Warning.Printf("got %v, stopping (send it again to exit immediately)", received)
+		cancel()
+		<-signals
+		os.Exit(exitFailure)
+	}()
+
+	return ctx
+}
 
-	// make connection to clickhouse server
-	ClickhouseConnection, err := sqlx.Open("clickhouse", ClickhouseConnectionString)
-	if err != nil {
-		logs.Error.Fatalf("can't connect to clickouse server, %v", err)
-	}
+func main() {
 
-	defer ClickhouseConnection.Close()
+	logs.Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
 
-	if err = ClickhouseConnection.Ping(); err != nil {
-		if exception, ok := err.(*clickhouse.Exception); ok {
-			logs.Error.Fatalf("[%d] %s \n%s\n", exception.Code, exception.Message, exception.StackTrace)
-		} else {
-			logs.Error.Fatalln(err)
-		}
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
 	}
 
-	// determine run mode
-	if *argBackup && !*argRestore { //Backup mode
-
-		logs.Info.Println("Run in backup mode")
-
-		if *argInDirectory == "" {
-			inputDirectory = "/var/lib/clickhouse"
-		} else {
-			inputDirectory = *argInDirectory
-		}
-
-		if *argOutDirectory == "" {
-			logs.Error.Fatalln("please set destination directory")
-		} else {
-			outputDirectory = *argOutDirectory
-		}
-
-		err, noDirectory := fileutils.IsDirectoryInListExist(inputDirectory, outputDirectory)
-		if err != nil {
-			logs.Error.Fatalf("%v not found", noDirectory)
-		}
-
-		if *argDataBase == "" { //backup all databases
-			// get partitions list for databases or database (--db argument)
-			DatabaseList := GetDatabasesList{}
-			err = DatabaseList.Run(ClickhouseConnection)
-			if err != nil {
-				logs.Error.Printf("can't get database list, %v", err)
-			}
-			for _, Database := range DatabaseList.Result {
-				cmdGetPartitionsList := parts.GetPartitions{Database: Database.Name}
-				err = cmdGetPartitionsList.Run(ClickhouseConnection)
-				if err != nil {
-					logs.Error.Printf("can't get partition list, %v", err)
-				}
-				cmdFreezePartitions := parts.FreezePartitions{
-					Partitions:           cmdGetPartitionsList.Result,
-					SourceDirectory:      inputDirectory,
-					DestinationDirectory: outputDirectory,
-					NoFreezeFlag:         *argNoFreeze,
-				}
-				err = cmdFreezePartitions.Run(ClickhouseConnection)
-				if err != nil {
-					logs.Error.Printf("can't freeze partition, %v", err)
-				}
-			}
-		} else { //backup specify database
-			cmdGetPartitionsList := parts.GetPartitions{Database: *argDataBase}
-			err = cmdGetPartitionsList.Run(ClickhouseConnection)
-			if err != nil {
-				logs.Error.Printf("can't get partition list, %v", err)
-			}
-			cmdFreezePartitions := parts.FreezePartitions{
-				Partitions:           cmdGetPartitionsList.Result,
-				SourceDirectory:      inputDirectory,
-				DestinationDirectory: outputDirectory,
-				NoFreezeFlag:         *argNoFreeze,
-			}
-			err = cmdFreezePartitions.Run(ClickhouseConnection)
-			if err != nil {
-				logs.Error.Printf("can't freeze partition, %v", err)
-			}
-		}
-
-		// clean up backup directory
-		if !*argNoCleanUp {
-			logs.Info.Printf("clean up %v", inputDirectory+"/shadow/backup")
-			os.RemoveAll(inputDirectory + "/shadow/backup")
-		}
-	} else if *argRestore && !*argBackup {
-
-		fmt.Println("Run in restore mode")
-
-		if *argInDirectory == "" {
-			logs.Error.Fatalln("please set source directory")
-		} else {
-			inputDirectory = *argInDirectory
-		}
-
-		if *argOutDirectory == "" {
-			outputDirectory = "/var/lib/clickhouse"
-		} else {
-			outputDirectory = *argOutDirectory
-		}
-
-		if *argDataBase == "" {
-			logs.Error.Fatalln("please set database for restore")
-		}
-
-		err, noDirectory := fileutils.IsDirectoryInListExist(inputDirectory, outputDirectory)
-		if err != nil {
-			logs.Error.Fatalf("%v not found", noDirectory)
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) == 0 {
+			usage()
+			os.Exit(exitOK)
 		}
+		name, args = args[0], []string{"-help"}
+	case "-version", "--version":
+		name = "version"
+	}
 
-		cmdRestoreDatabase := restore.RestoreDatabase{
-			DatabaseName:         *argDataBase,
-			SourceDirectory:      inputDirectory,
-			DestinationDirectory: outputDirectory,
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(signalContext(), args))
 		}
-		err = cmdRestoreDatabase.Run(ClickhouseConnection)
-		if err != nil {
-			logs.Error.Printf("can't restore database, %v", err)
-		}
-
-	} else if !*argRestore && !*argBackup {
-		fmt.Println("run with --help for help")
-	} else {
-		logs.Error.Fatalln("Run in only one mode (backup or restore)")
 	}
 
+	fmt.Fprintf(os.Stderr, "ERROR: unknown command %v\n\n", name)
+	usage()
+	os.Exit(exitUsage)
 }
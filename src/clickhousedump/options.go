@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypt"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/jmoiron/sqlx"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	parts "partutils"
+	"path"
+	"s3"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of commands
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// Create flags of command with usage text, every command reads configuration file
+func newFlagSet(name string, arguments string, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: clickhousedump %v %v\n\n%v\n\nFlags:\n", name, arguments, description)
+		flags.PrintDefaults()
+	}
+	flags.String("config", defaultConfigFile, "configuration file (YAML or TOML), "+envPrefix+"* environment variables and flags override it")
+	flags.Bool("print-config", false, "print effective configuration and exit")
+	return flags
+}
+
+// Parse command arguments and apply configuration, done is true when command must exit with status
+func parseFlags(flags *flag.FlagSet, args []string) (status int, done bool) {
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return usageError(flags, "unexpected argument %v", flags.Arg(0)), true
+	}
+
+	sources, err := applyConfig(flags)
+	if err != nil {
+		return usageError(flags, "%v", err), true
+	}
+
+	if flags.Lookup("print-config").Value.String() == "true" {
+		printConfig(flags, sources)
+		return exitOK, true
+	}
+
+	return exitOK, false
+}
+
+// Show error with command usage
+func usageError(flags *flag.FlagSet, format string, args ...interface{}) int {
+	fmt.Fprintf(flags.Output(), "ERROR: "+format+"\n\n", args...)
+	flags.Usage()
+	return exitUsage
+}
+
+type connectionOptions struct {
+	host            string
+	port            string
+	debug           bool
+	user            string
+	password        string
+	passwordFile    string
+	defaultDatabase string
+	secure          bool
+	skipVerify      bool
+	tlsCA           string
+	tlsCert         string
+	tlsKey          string
+	connectTimeout  time.Duration
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	altHosts        string
+}
+
+func (co *connectionOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&co.host, "h", "127.0.0.1", "server hostname")
+	flags.StringVar(&co.port, "p", "9000", "server port")
+	flags.BoolVar(&co.debug, "d", false, "show debug info")
+	flags.StringVar(&co.user, "user", "default", "clickhouse user")
+	flags.StringVar(&co.password, "password", "", "clickhouse user password")
+	flags.StringVar(&co.passwordFile, "password-file", "", "file with clickhouse user password")
+	flags.StringVar(&co.defaultDatabase, "default-database", "", "default database of connection")
+	flags.BoolVar(&co.secure, "secure", false, "use TLS connection")
+	flags.BoolVar(&co.skipVerify, "tls-skip-verify", false, "do not verify server TLS certificate")
+	flags.StringVar(&co.tlsCA, "tls-ca", "", "file with CA certificates to verify server TLS certificate (implies -secure)")
+	flags.StringVar(&co.tlsCert, "tls-cert", "", "client TLS certificate file (implies -secure)")
+	flags.StringVar(&co.tlsKey, "tls-key", "", "client TLS certificate key file (implies -secure)")
+	flags.DurationVar(&co.connectTimeout, "connect-timeout", 0, "connection timeout (for example 10s, driver default if not set)")
+	flags.DurationVar(&co.readTimeout, "read-timeout", 0, "read timeout (for example 30s, driver default if not set)")
+	flags.DurationVar(&co.writeTimeout, "write-timeout", 0, "write timeout (for example 30s, driver default if not set)")
+	flags.StringVar(&co.altHosts, "alt-hosts", "", "comma separated host:port list, used in order when server is not available")
+}
+
+// Build connection string for clickhouse driver
+func (co *connectionOptions) connectionString() (string, error) {
+	query := url.Values{}
+
+	password := co.password
+	if co.passwordFile != "" {
+		content, err := ioutil.ReadFile(co.passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("can't read password file, %v", err)
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+
+	query.Set("username", co.user)
+	if password != "" {
+		query.Set("password", password)
+	}
+	if co.defaultDatabase != "" {
+		query.Set("database", co.defaultDatabase)
+	}
+	query.Set("compress", "true")
+	if co.tlsCA != "" || co.tlsCert != "" || co.tlsKey != "" {
+		tlsConfig, err := co.tlsConfig()
+		if err != nil {
+			return "", err
+		}
+		if err = clickhouse.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+			return "", err
+		}
+		query.Set("tls_config", tlsConfigName)
+		// driver verifies server certificate unless skip_verify is set, also with registered TLS config
+		query.Set("skip_verify", strconv.FormatBool(co.skipVerify))
+	} else if co.secure {
+		query.Set("secure", "true")
+		query.Set("skip_verify", strconv.FormatBool(co.skipVerify))
+	}
+	if co.connectTimeout > 0 {
+		query.Set("timeout", strconv.FormatFloat(co.connectTimeout.Seconds(), 'f', -1, 64))
+	}
+	if co.readTimeout > 0 {
+		query.Set("read_timeout", strconv.FormatFloat(co.readTimeout.Seconds(), 'f', -1, 64))
+	}
+	if co.writeTimeout > 0 {
+		query.Set("write_timeout", strconv.FormatFloat(co.writeTimeout.Seconds(), 'f', -1, 64))
+	}
+	if co.altHosts != "" {
+		query.Set("alt_hosts", co.altHosts)
+		query.Set("connection_open_strategy", "in_order")
+	}
+	if co.debug {
+		query.Set("debug", "true")
+	}
+
+	return "tcp://" + net.JoinHostPort(co.host, co.port) + "?" + query.Encode(), nil
+}
+
+// Name of TLS configuration registered in clickhouse driver
+const tlsConfigName = "clickhousedump"
+
+// Build TLS configuration with CA and client certificate, driver uses it instead of secure parameter
+func (co *connectionOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: co.skipVerify}
+
+	if co.tlsCA != "" {
+		content, err := ioutil.ReadFile(co.tlsCA)
+		if err != nil {
+			return nil, fmt.Errorf("can't read CA file, %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates in CA file %v", co.tlsCA)
+		}
+	}
+
+	if co.tlsCert != "" || co.tlsKey != "" {
+		if co.tlsCert == "" || co.tlsKey == "" {
+			return nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(co.tlsCert, co.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate, %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// Connect to clickhouse server and check connection
+func (co *connectionOptions) connect() (*sqlx.DB, error) {
+	var err error
+
+	ClickhouseConnectionString, err = co.connectionString()
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := sqlx.Open("clickhouse", ClickhouseConnectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = connection.Ping(); err != nil {
+		connection.Close()
+		if exception, ok := err.(*clickhouse.Exception); ok {
+			return nil, fmt.Errorf("[%d] %s \n%s", exception.Code, exception.Message, exception.StackTrace)
+		}
+		return nil, err
+	}
+
+	return connection, nil
+}
+
+// Repeatable flag with glob patterns, value may be comma separated list
+type patternList []string
+
+func (pl *patternList) String() string {
+	return strings.Join(*pl, ",")
+}
+
+func (pl *patternList) Set(value string) error {
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %v", pattern)
+		}
+		*pl = append(*pl, pattern)
+	}
+	return nil
+}
+
+type filterOptions struct {
+	include patternList
+	exclude patternList
+}
+
+func (fo *filterOptions) register(flags *flag.FlagSet) {
+	flags.Var(&fo.include, "include", "include only tables matched by database.table glob pattern (for example analytics.events_*), repeatable")
+	flags.Var(&fo.exclude, "exclude", "exclude tables matched by database.table glob pattern (for example *.tmp_*), repeatable")
+}
+
+func (fo *filterOptions) filter() parts.TableFilter {
+	return parts.TableFilter{Include: fo.include, Exclude: fo.exclude}
+}
+
+type storageOptions struct {
+	s3Bucket          string
+	s3Prefix          string
+	s3Endpoint        string
+	s3Region          string
+	s3PathStyle       bool
+	s3PartSize        int64
+	s3AccessKey       string
+	s3SecretKey       string
+	sftpHost          string
+	sftpDirectory     string
+	sftpUser          string
+	sftpKey           string
+	sftpKnownHosts    string
+	encryptionKeyFile string
+}
+
+func (so *storageOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&so.s3Bucket, "s3-bucket", "", "S3 bucket with backups, backup names are relative to -s3-prefix")
+	flags.StringVar(&so.s3Prefix, "s3-prefix", "", "S3 key prefix for backups")
+	flags.StringVar(&so.s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 endpoint url")
+	flags.StringVar(&so.s3Region, "s3-region", "us-east-1", "S3 region")
+	flags.BoolVar(&so.s3PathStyle, "s3-path-style", false, "use path-style S3 urls (for MinIO and other S3-compatible storages)")
+	flags.Int64Var(&so.s3PartSize, "s3-part-size", 64, "S3 multipart upload part size in megabytes")
+	flags.StringVar(&so.s3AccessKey, "s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 access key ($AWS_ACCESS_KEY_ID by default)")
+	flags.StringVar(&so.s3SecretKey, "s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "S3 secret key ($AWS_SECRET_ACCESS_KEY by default)")
+	flags.StringVar(&so.sftpHost, "sftp-host", "", "SFTP host[:port] with backups, backup names are relative to -sftp-directory")
+	flags.StringVar(&so.sftpDirectory, "sftp-directory", "", "SFTP directory for backups")
+	flags.StringVar(&so.sftpUser, "sftp-user", os.Getenv("USER"), "SFTP user ($USER by default)")
+	flags.StringVar(&so.sftpKey, "sftp-key", path.Join(os.Getenv("HOME"), ".ssh/id_rsa"), "SFTP private key file")
+	flags.StringVar(&so.sftpKnownHosts, "sftp-known-hosts", path.Join(os.Getenv("HOME"), ".ssh/known_hosts"), "known_hosts file for SFTP host key check")
+	flags.StringVar(&so.encryptionKeyFile, "encryption-key", "", "file with 32 bytes key (raw or hex) for AES-256-GCM encryption of backup files")
+}
+
+// Open remote storage (nil for local backups) and load encryption key (nil without encryption)
+func (so *storageOptions) open() (remoteStorage, *crypt.Key, func(), error) {
+	var (
+		err           error
+		remote        remoteStorage
+		encryptionKey *crypt.Key
+		closeRemote   = func() {}
+	)
+
+	if so.encryptionKeyFile != "" {
+		encryptionKey, err = crypt.LoadKey(so.encryptionKeyFile)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("can't load encryption key, %v", err)
+		}
+	}
+
+	if so.s3Bucket != "" && so.sftpHost != "" {
+		return nil, nil, nil, fmt.Errorf("use only one remote storage (S3 or SFTP)")
+	}
+
+	if so.s3Bucket != "" {
+		s3Client, err := s3.New(s3.Config{
+			Endpoint:  so.s3Endpoint,
+			Region:    so.s3Region,
+			Bucket:    so.s3Bucket,
+			AccessKey: so.s3AccessKey,
+			SecretKey: so.s3SecretKey,
+			PathStyle: so.s3PathStyle,
+			PartSize:  so.s3PartSize * 1024 * 1024,
+		}, nil)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("can't create S3 client, %v", err)
+		}
+		remote = func(name string) storage.Storage {
+			return &storage.S3{Client: s3Client, Prefix: path.Join(so.s3Prefix, name)}
+		}
+	}
+
+	if so.sftpHost != "" {
+		sftpStorage, err := storage.DialSFTP(storage.SFTPConfig{
+			Address:        so.sftpHost,
+			User:           so.sftpUser,
+			KeyFile:        so.sftpKey,
+			KnownHostsFile: so.sftpKnownHosts,
+		}, so.sftpDirectory)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("can't connect to SFTP host, %v", err)
+		}
+		remote = func(name string) storage.Storage {
+			return sftpStorage.Sub(name)
+		}
+		closeRemote = func() { sftpStorage.Close() }
+	}
+
+	return remote, encryptionKey, closeRemote, nil
+}
+
+// Open backup directory or directory with backups in remote or local storage
+func openDirectory(remote remoteStorage, name string) storage.Storage {
+	if remote != nil {
+		return remote(name)
+	}
+	return &storage.Local{Directory: name}
+}
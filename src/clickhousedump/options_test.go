@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestConnectionString(t *testing.T) {
+	passwordFile, err := ioutil.TempFile("", "options_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwordFile.Name())
+	passwordFile.WriteString("secret&1\n")
+	passwordFile.Close()
+
+	tests := []struct {
+		options  connectionOptions
+		expected string
+	}{
+		{
+			connectionOptions{host: "127.0.0.1", port: "9000", user: "default"},
+			"tcp://127.0.0.1:9000?compress=true&username=default",
+		},
+		{
+			connectionOptions{host: "::1", port: "9440", user: "backup", passwordFile: passwordFile.Name(), defaultDatabase: "system", secure: true},
+			"tcp://[::1]:9440?compress=true&database=system&password=secret%261&secure=true&skip_verify=false&username=backup",
+		},
+		{
+			connectionOptions{host: "ch-1", port: "9000", user: "default", connectTimeout: 10 * time.Second, readTimeout: 1500 * time.Millisecond, altHosts: "ch-2:9000,ch-3:9000"},
+			"tcp://ch-1:9000?alt_hosts=ch-2%3A9000%2Cch-3%3A9000&compress=true&connection_open_strategy=in_order&read_timeout=1.5&timeout=10&username=default",
+		},
+	}
+
+	for _, test := range tests {
+		connectionString, err := test.options.connectionString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connectionString != test.expected {
+			t.Errorf("got %v, expected %v", connectionString, test.expected)
+		}
+	}
+
+	options := connectionOptions{host: "ch-1", port: "9000", passwordFile: passwordFile.Name() + "_not_exists"}
+	if _, err := options.connectionString(); err == nil {
+		t.Errorf("got no error for missing password file")
+	}
+	options = connectionOptions{host: "ch-1", port: "9000", tlsCert: passwordFile.Name()}
+	if _, err := options.connectionString(); err == nil {
+		t.Errorf("got no error for -tls-cert without -tls-key")
+	}
+	if _, err := url.Parse(tests[1].expected); err != nil {
+		t.Error(err)
+	}
+}
+
+// Write self-signed certificate and its key to directory, certificate is used as CA too
+func writeTestCertificate(t *testing.T, directory string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clickhousedump test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = path.Join(directory, "cert.pem"), path.Join(directory, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestConnectionStringTLSConfig(t *testing.T) {
+	directory, err := ioutil.TempDir("", "options_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	certFile, keyFile := writeTestCertificate(t, directory)
+
+	tests := []struct {
+		options  connectionOptions
+		expected string
+	}{
+		{
+			connectionOptions{host: "ch-1", port: "9440", user: "default", tlsCA: certFile},
+			"tcp://ch-1:9440?compress=true&skip_verify=false&tls_config=clickhousedump&username=default",
+		},
+		{
+			connectionOptions{host: "ch-1", port: "9440", user: "default", tlsCA: certFile, tlsCert: certFile, tlsKey: keyFile, skipVerify: true},
+			"tcp://ch-1:9440?compress=true&skip_verify=true&tls_config=clickhousedump&username=default",
+		},
+	}
+
+	for _, test := range tests {
+		connectionString, err := test.options.connectionString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connectionString != test.expected {
+			t.Errorf("got %v, expected %v", connectionString, test.expected)
+		}
+	}
+
+	config, err := tests[1].options.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 1 || !config.InsecureSkipVerify {
+		t.Errorf("got TLS config with CA %v, %v certificates and skip verify %v", config.RootCAs != nil, len(config.Certificates), config.InsecureSkipVerify)
+	}
+
+	options := connectionOptions{host: "ch-1", port: "9440", tlsCA: keyFile}
+	if _, err := options.connectionString(); err == nil {
+		t.Errorf("got no error for CA file without certificates")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypt"
+	"errors"
+	"fmt"
+	"io"
+	logs "logging"
+	"manifest"
+	"os"
+	"path"
+	"restore"
+	"storage"
+	"tarball"
+)
+
+// Open backup directory in S3 bucket or on SFTP host, nil for local backups
+type remoteStorage func(name string) storage.Storage
+
+// Encrypt backup files with key, manifest header is not encrypted
+func encryptedStorage(backupStorage storage.Storage, key *crypt.Key) storage.Storage {
+	if key == nil {
+		return backupStorage
+	}
+	return &storage.Encrypted{
+		Storage:    backupStorage,
+		Key:        key,
+		PlainFiles: []string{manifest.FileName},
+	}
+}
+
+// Open backup destination: archive file or stdout, remote or local directory,
+// files in directory or whole archive are encrypted with key. Returned function
+// closes destination, archive of failed backup (err is not nil) is discarded
+func openBackupDestination(name string, compression string, remote remoteStorage, key *crypt.Key) (storage.Storage, func(err error) error, error) {
+	if compression == "" {
+		if remote != nil {
+			return encryptedStorage(remote(name), key), func(error) error { return nil }, nil
+		}
+		return encryptedStorage(&storage.Local{Directory: name}, key), func(error) error { return nil }, nil
+	}
+
+	// local archive is written to temporary file and renamed on successful close
+	var archiveFile io.WriteCloser = os.Stdout
+	if name != "-" {
+		var err error
+		if remote != nil {
+			archiveFile, err = remote("").Put(name, -1)
+		} else {
+			archiveFile, err = (&storage.Local{Directory: path.Dir(name)}).Put(path.Base(name), -1)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var archiveStream io.WriteCloser = archiveFile
+	if key != nil {
+		var err error
+		if archiveStream, err = crypt.NewWriter(archiveFile, key); err != nil {
+			return nil, nil, storage.AbortWriter(archiveFile, err)
+		}
+	}
+
+	archiveWriter, err := tarball.NewWriter(archiveStream, compression)
+	if err != nil {
+		return nil, nil, storage.AbortWriter(archiveFile, err)
+	}
+
+	closeArchive := func(err error) error {
+		if err != nil {
+			logs.Warning.Printf("discard archive %v of failed backup", name)
+			storage.AbortWriter(archiveFile, err)
+			return nil
+		}
+		if err := archiveWriter.Close(); err != nil {
+			return storage.AbortWriter(archiveFile, err)
+		}
+		if archiveStream != archiveFile {
+			if err := archiveStream.Close(); err != nil {
+				return storage.AbortWriter(archiveFile, err)
+			}
+		}
+		return archiveFile.Close()
+	}
+
+	return &storage.Archive{Writer: archiveWriter}, closeArchive, nil
+}
+
+// Open backup source: remote or local directory, archives and stdin stream are extracted
+// to temporary directory, with metadataOnly only metadata is read in memory and parts are listed
+func openBackupSource(ctx context.Context, name string, databaseName string, temporaryDirectory string, metadataOnly bool, remote remoteStorage, key *crypt.Key) (storage.Storage, string, error) {
+	var archiveFile io.ReadCloser = os.Stdin
+
+	if remote != nil {
+		backupStorage := remote(name)
+		_, err := backupStorage.Stat(manifest.FileName)
+		if err == nil {
+			return encryptedStorage(backupStorage, key), "", nil
+		}
+		if !storage.IsNotExist(err) {
+			return nil, "", err
+		}
+
+		// backup without manifest is archive
+		if archiveFile, err = remote("").Get(name); err != nil {
+			return nil, "", err
+		}
+	} else if name != "-" {
+		inputInfo, err := os.Stat(name)
+		if err != nil {
+			return nil, "", err
+		}
+		if inputInfo.IsDir() {
+			return encryptedStorage(&storage.Local{Directory: name}, key), "", nil
+		}
+		if archiveFile, err = os.Open(name); err != nil {
+			return nil, "", err
+		}
+	}
+	defer archiveFile.Close()
+
+	var archiveStream io.Reader = bufio.NewReader(archiveFile)
+	if key != nil {
+		var err error
+		if archiveStream, err = crypt.NewReader(archiveStream, key); err != nil {
+			return nil, "", err
+		}
+	} else if header, _ := archiveStream.(*bufio.Reader).Peek(8); crypt.IsEncrypted(header) {
+		return nil, "", errors.New("backup archive is encrypted, set encryption key")
+	}
+
+	cmdExtractArchive := restore.ExtractArchive{
+		Source:             archiveStream,
+		DatabaseName:       databaseName,
+		TemporaryDirectory: temporaryDirectory,
+		MetadataOnlyFlag:   metadataOnly,
+	}
+	if err := cmdExtractArchive.Run(ctx); err != nil {
+		return nil, "", err
+	}
+
+	return cmdExtractArchive.Result, cmdExtractArchive.Directory, nil
+}
+
+// Check backup manifest encryption key, backups without manifest are not checked
+func checkBackupEncryption(source storage.Storage, key *crypt.Key) error {
+	backupManifest, err := manifest.ReadHeader(source)
+	if storage.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return backupManifest.CheckEncryption(key)
+}
+
+// Read manifest of backup which is not marked as incomplete, backups without manifest have nil manifest
+func readCompleteManifest(source storage.Storage) (*manifest.Manifest, error) {
+	backupManifest, err := manifest.Read(source)
+	if storage.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if backupManifest.Incomplete != "" {
+		return nil, fmt.Errorf("backup is incomplete, %v", backupManifest.Incomplete)
+	}
+	return backupManifest, nil
+}
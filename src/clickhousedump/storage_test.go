@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	logs "logging"
+	"os"
+	"storage"
+	"tarball"
+	"testing"
+)
+
+func TestOpenBackupDestinationArchive(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	directory, err := ioutil.TempDir("", "clickhousedump_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	archiveName := directory + "/backup.tar"
+
+	for _, failedErr := range []error{errors.New("failed"), nil} {
+		destination, closeDestination, err := openBackupDestination(archiveName, tarball.CompressionNone, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = storage.PutBytes(destination, "manifest.json", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(archiveName); !os.IsNotExist(err) {
+			t.Errorf("archive exists before close (%v)", err)
+		}
+		if err = closeDestination(failedErr); err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := ioutil.ReadDir(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		expected := "[backup.tar]"
+		if failedErr != nil {
+			expected = "[]"
+		}
+		if got := fmt.Sprint(names); got != expected {
+			t.Errorf("closed with %v: got files %v, expected %v", failedErr, got, expected)
+		}
+	}
+}
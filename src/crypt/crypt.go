@@ -0,0 +1,248 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encryption algorithm name for backup manifest
+const Algorithm = "AES-256-GCM-HKDF-SHA256"
+
+// Encrypted stream is header (magic and random salt) and sequence of chunks, each chunk
+// is sealed with stream key derived from key and salt and with chunk number as nonce,
+// last chunk is marked in additional data
+const (
+	magic         = "CHDUMPE2"
+	saltSize      = 32
+	headerSize    = len(magic) + saltSize
+	chunkSize     = 64 * 1024
+	tagSize       = 16
+	sealedSize    = chunkSize + tagSize
+	lastChunkFlag = 1
+)
+
+var (
+	ErrAuthentication = errors.New("encrypted data is damaged or key is wrong")
+	ErrNotEncrypted   = errors.New("data is not encrypted")
+)
+
+type Key struct {
+	ID     string
+	secret []byte
+}
+
+// Create key from 32 bytes, key ID is prefix of key SHA-256
+func NewKey(key []byte) (*Key, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %v", len(key))
+	}
+	keyHash := sha256.Sum256(key)
+	return &Key{
+		ID:     hex.EncodeToString(keyHash[:8]),
+		secret: append([]byte{}, key...),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Derive key of stream with salt, every stream has own key, so chunk numbers are unique nonces
+func (k *Key) streamAEAD(salt []byte) (cipher.AEAD, error) {
+	streamKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.secret, salt, []byte("clickhousedump stream key")), streamKey); err != nil {
+		return nil, err
+	}
+	return newAEAD(streamKey)
+}
+
+// Read key from file with 32 raw bytes or 64 hex digits
+func LoadKey(fileName string) (*Key, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if text := strings.TrimSpace(string(content)); len(text) == 64 {
+		if key, err := hex.DecodeString(text); err == nil {
+			return NewKey(key)
+		}
+	}
+	return NewKey(content)
+}
+
+// Check stream starts with encrypted stream header
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(magic))
+}
+
+// Size of plain data for encrypted stream size
+func PlainSize(size int64) int64 {
+	size -= int64(headerSize)
+	chunks := (size + sealedSize - 1) / sealedSize
+	return size - chunks*tagSize
+}
+
+// Nonce of chunk is chunk number, every stream has own key
+func nonce(aead cipher.AEAD, chunk uint32) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], chunk)
+	return nonce
+}
+
+type writer struct {
+	aead        cipher.AEAD
+	destination io.Writer
+	chunk       uint32
+	buffer      []byte
+}
+
+// Encrypt stream to destination, Close writes last chunk but does not close destination
+func NewWriter(destination io.Writer, key *Key) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := key.streamAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := destination.Write(append([]byte(magic), salt...)); err != nil {
+		return nil, err
+	}
+	return &writer{
+		aead:        aead,
+		destination: destination,
+		buffer:      make([]byte, 0, sealedSize),
+	}, nil
+}
+
+func (w *writer) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		length := chunkSize - len(w.buffer)
+		if length > len(data) {
+			length = len(data)
+		}
+		w.buffer = append(w.buffer, data[:length]...)
+		data = data[length:]
+		written += length
+
+		if len(w.buffer) == chunkSize {
+			if err := w.seal(0); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *writer) seal(flag byte) error {
+	sealed := w.aead.Seal(w.buffer[:0], nonce(w.aead, w.chunk), w.buffer, []byte{flag})
+	w.chunk++
+	if w.chunk == 0 {
+		return errors.New("encrypted stream is too long")
+	}
+	_, err := w.destination.Write(sealed)
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+func (w *writer) Close() error {
+	return w.seal(lastChunkFlag)
+}
+
+type reader struct {
+	aead   cipher.AEAD
+	source *bufio.Reader
+	chunk  uint32
+	sealed []byte
+	plain  []byte
+	last   bool
+}
+
+// Decrypt stream, truncated or modified stream is reported as ErrAuthentication
+func NewReader(source io.Reader, key *Key) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	if err := readHeader(source, header); err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(header) {
+		return nil, ErrNotEncrypted
+	}
+
+	aead, err := key.streamAEAD(header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		aead:   aead,
+		source: bufio.NewReaderSize(source, sealedSize),
+		sealed: make([]byte, sealedSize),
+	}, nil
+}
+
+// Read part of stream header, short stream is not encrypted
+func readHeader(source io.Reader, header []byte) error {
+	_, err := io.ReadFull(source, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrNotEncrypted
+	}
+	return err
+}
+
+func (r *reader) Read(data []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	length := copy(data, r.plain)
+	r.plain = r.plain[length:]
+	return length, nil
+}
+
+// Read and decrypt next chunk, chunk is last when stream ends after it
+func (r *reader) open() error {
+	length, err := io.ReadFull(r.source, r.sealed)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.last = true
+	} else if err != nil {
+		return err
+	} else if _, err = r.source.Peek(1); err == io.EOF {
+		r.last = true
+	} else if err != nil {
+		return err
+	}
+
+	flag := byte(0)
+	if r.last {
+		flag = lastChunkFlag
+	}
+	plain, err := r.aead.Open(r.sealed[:0], nonce(r.aead, r.chunk), r.sealed[:length], []byte{flag})
+	if err != nil {
+		return ErrAuthentication
+	}
+	r.chunk++
+	r.plain = plain
+	return nil
+}
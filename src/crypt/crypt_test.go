@@ -0,0 +1,137 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func testKey(t *testing.T, seed byte) *Key {
+	key, err := NewKey(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, key *Key, plain []byte) []byte {
+	var encrypted bytes.Buffer
+	writer, err := NewWriter(&encrypted, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write by pieces not aligned with chunks
+	for len(plain) > 0 {
+		length := 10000
+		if length > len(plain) {
+			length = len(plain)
+		}
+		if _, err = writer.Write(plain[:length]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[length:]
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return encrypted.Bytes()
+}
+
+func decrypt(key *Key, encrypted []byte) ([]byte, error) {
+	reader, err := NewReader(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// Lengths around chunk boundaries
+var testLengths = []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 2 * chunkSize, 3*chunkSize + 12345}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t, 1)
+	for _, length := range testLengths {
+		plain := make([]byte, length)
+		for i := range plain {
+			plain[i] = byte(i * 7)
+		}
+
+		encrypted := encrypt(t, key, plain)
+		if !IsEncrypted(encrypted) {
+			t.Errorf("%v bytes: encrypted stream has no header", length)
+		}
+		if size := PlainSize(int64(len(encrypted))); size != int64(length) {
+			t.Errorf("%v bytes: plain size of %v encrypted bytes is %v", length, len(encrypted), size)
+		}
+
+		decrypted, err := decrypt(key, encrypted)
+		if err != nil {
+			t.Errorf("%v bytes: %v", length, err)
+		} else if !bytes.Equal(decrypted, plain) {
+			t.Errorf("%v bytes: decrypted data differs from plain data", length)
+		}
+	}
+}
+
+func TestDamagedStream(t *testing.T) {
+	key := testKey(t, 1)
+	plain := bytes.Repeat([]byte("data"), chunkSize)
+	encrypted := encrypt(t, key, plain)
+
+	tests := []struct {
+		name      string
+		key       *Key
+		encrypted []byte
+	}{
+		{"wrong key", testKey(t, 2), encrypted},
+		{"truncated at chunk boundary", key, encrypted[:headerSize+sealedSize]},
+		{"truncated in chunk", key, encrypted[:headerSize+sealedSize+100]},
+		{"last chunk removed", key, encrypted[:len(encrypted)-tagSize-(len(plain)%chunkSize)]},
+		{"modified byte", key, append(append(append([]byte{}, encrypted[:headerSize+10]...), encrypted[headerSize+10]^1), encrypted[headerSize+11:]...)},
+		{"chunks swapped", key, append(append(append([]byte{}, encrypted[:headerSize]...), encrypted[headerSize+sealedSize:headerSize+2*sealedSize]...), encrypted[headerSize:headerSize+sealedSize]...)},
+	}
+
+	for _, test := range tests {
+		if _, err := decrypt(test.key, test.encrypted); err != ErrAuthentication {
+			t.Errorf("%v: got %v, expected %v", test.name, err, ErrAuthentication)
+		}
+	}
+}
+
+func TestNotEncrypted(t *testing.T) {
+	key := testKey(t, 1)
+	for _, data := range []string{"", "short", "plain data longer than header"} {
+		if _, err := decrypt(key, []byte(data)); err != ErrNotEncrypted {
+			t.Errorf("%q: got %v, expected %v", data, err, ErrNotEncrypted)
+		}
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	if _, err := NewKey(make([]byte, 16)); err == nil {
+		t.Error("key of 16 bytes is accepted")
+	}
+	if testKey(t, 1).ID == testKey(t, 2).ID {
+		t.Error("different keys have same ID")
+	}
+}
+
+func TestStreamKeys(t *testing.T) {
+	key := testKey(t, 1)
+	plain := []byte("same data")
+	first := encrypt(t, key, plain)
+	second := encrypt(t, key, plain)
+
+	if bytes.Equal(first[:headerSize], second[:headerSize]) || bytes.Equal(first[headerSize:], second[headerSize:]) {
+		t.Error("streams of same data have same salt or chunks")
+	}
+	if size := PlainSize(int64(len(first))); size != int64(len(plain)) {
+		t.Errorf("plain size is %v, expected %v", size, len(plain))
+	}
+
+	// chunks are sealed with key derived from salt
+	modified := append(append(append([]byte{}, first[:len(magic)]...), second[len(magic):headerSize]...), first[headerSize:]...)
+	if _, err := decrypt(key, modified); err != ErrAuthentication {
+		t.Errorf("salt replaced: got %v, expected %v", err, ErrAuthentication)
+	}
+}
@@ -1,16 +1,20 @@
 package fileutils
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	logs "logging"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 )
 
-// Recursive copy directory and files
-func CopyDirectory(sourceDirectory string, destinationDirectory string) error {
+// Recursive copy directory and files, copy stops when context is canceled
+func CopyDirectory(ctx context.Context, sourceDirectory string, destinationDirectory string) error {
 
 	var (
 		err             error
@@ -30,16 +34,19 @@ func CopyDirectory(sourceDirectory string, destinationDirectory string) error {
 		return err
 	}
 	for _, fileDescriptor := range fileDescriptors {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 		if !strings.HasPrefix(fileDescriptor.Name(), "%2Einner%2E") {
 			sourcePath := path.Join(sourceDirectory, fileDescriptor.Name())
 			destinationPath := path.Join(destinationDirectory, fileDescriptor.Name())
 			if fileDescriptor.IsDir() {
-				if err = CopyDirectory(sourcePath, destinationPath); err != nil {
-					logs.Error.Fatalln(err)
+				if err = CopyDirectory(ctx, sourcePath, destinationPath); err != nil {
+					return err
 				}
 			} else {
 				if err = CopyFile(sourcePath, destinationPath); err != nil {
-					logs.Error.Fatalln(err)
+					return fmt.Errorf("can't copy %v, %v", sourcePath, err)
 				}
 			}
 		}
@@ -47,6 +54,73 @@ func CopyDirectory(sourceDirectory string, destinationDirectory string) error {
 	return nil
 }
 
+// Recursive create hardlinks for all files from source directory, fallback to copy on error
+func LinkDirectory(sourceDirectory string, destinationDirectory string) error {
+
+	var (
+		err             error
+		fileDescriptors []os.FileInfo
+		sourceInfo      os.FileInfo
+	)
+
+	if sourceInfo, err = os.Stat(sourceDirectory); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(destinationDirectory, sourceInfo.Mode()); err != nil {
+		return err
+	}
+
+	if fileDescriptors, err = ioutil.ReadDir(sourceDirectory); err != nil {
+		return err
+	}
+	for _, fileDescriptor := range fileDescriptors {
+		sourcePath := path.Join(sourceDirectory, fileDescriptor.Name())
+		destinationPath := path.Join(destinationDirectory, fileDescriptor.Name())
+		if fileDescriptor.IsDir() {
+			if err = LinkDirectory(sourcePath, destinationPath); err != nil {
+				return err
+			}
+		} else if err = os.Link(sourcePath, destinationPath); err != nil {
+			logs.Warning.Printf("can't create hardlink %v, copy file, %v", destinationPath, err)
+			if err = CopyFile(sourcePath, destinationPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Move directory, copy it if rename is impossible (different filesystems)
+func MoveDirectory(ctx context.Context, sourceDirectory string, destinationDirectory string) error {
+	if err := os.MkdirAll(path.Dir(destinationDirectory), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(sourceDirectory, destinationDirectory); err != nil {
+		logs.Warning.Printf("can't move %v, copy it, %v", sourceDirectory, err)
+		if err = CopyDirectory(ctx, sourceDirectory, destinationDirectory); err != nil {
+			return err
+		}
+		return os.RemoveAll(sourceDirectory)
+	}
+
+	return nil
+}
+
+// Compare content of small files
+func IsFilesEqual(firstFile string, secondFile string) (bool, error) {
+	firstContent, err := ioutil.ReadFile(firstFile)
+	if err != nil {
+		return false, err
+	}
+	secondContent, err := ioutil.ReadFile(secondFile)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(firstContent, secondContent), nil
+}
+
 // Copy files
 func CopyFile(sourceFile string, destinationFile string) error {
 	fromFile, err := os.Open(sourceFile)
@@ -56,17 +130,28 @@ func CopyFile(sourceFile string, destinationFile string) error {
 
 	defer fromFile.Close()
 
-	toFile, err := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE, 0666)
+	fromInfo, err := fromFile.Stat()
 	if err != nil {
 		return err
 	}
-	defer toFile.Close()
 
-	_, err = io.Copy(toFile, fromFile)
+	toFile, err := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 
+	// write errors may be reported only by close
+	written, err := io.Copy(toFile, fromFile)
+	if closeErr := toFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if written != fromInfo.Size() {
+		return fmt.Errorf("copy %v: written %v bytes of %v", sourceFile, written, fromInfo.Size())
+	}
+
 	return nil
 }
 
@@ -141,3 +226,32 @@ func IsExists(filePath string) (bool, error) {
 	}
 	return true, err
 }
+
+// Get ID of device with file, files on the same disk have the same device ID
+func DeviceID(filePath string) (uint64, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("can't get device of %v", filePath)
+	}
+	return uint64(stat.Dev), nil
+}
+
+// Escape database or table name the same way as clickhouse does for directory names
+func EscapeForFileName(name string) string {
+	var result strings.Builder
+	for _, symbol := range []byte(name) {
+		if (symbol >= 'a' && symbol <= 'z') ||
+			(symbol >= 'A' && symbol <= 'Z') ||
+			(symbol >= '0' && symbol <= '9') ||
+			symbol == '_' {
+			result.WriteByte(symbol)
+		} else {
+			result.WriteString(fmt.Sprintf("%%%02X", symbol))
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,383 @@
+package manifest
+
+import (
+	"crypt"
+	"encoding/json"
+	"errors"
+	"fileutils"
+	"fmt"
+	"net/url"
+	parts "partutils"
+	"path"
+	"sort"
+	"storage"
+	"strings"
+	"tarball"
+	"time"
+)
+
+// Version of manifest format, increase on incompatible changes
+const FormatVersion = 1
+
+// Name of manifest file in backup directory
+const FileName = "manifest.json"
+
+// Name of file with databases of encrypted backup, it is encrypted as backup files
+// and manifest file keeps only header with backup size and encryption key ID
+const DatabasesFileName = "manifest.databases.json"
+
+type Manifest struct {
+	FormatVersion   int         `json:"format_version"`
+	ToolVersion     string      `json:"tool_version"`
+	BuildID         string      `json:"build_id"`
+	ServerVersion   string      `json:"server_version"`
+	StartTime       time.Time   `json:"start_time"`
+	EndTime         time.Time   `json:"end_time"`
+	ShadowName      string      `json:"shadow_name,omitempty"`
+	Incomplete      string      `json:"incomplete,omitempty"`
+	Failures        []string    `json:"failures,omitempty"`
+	IncrementalFrom string      `json:"incremental_from,omitempty"`
+	Encryption      *Encryption `json:"encryption,omitempty"`
+	TotalSize       int64       `json:"total_size,omitempty"`
+	Databases       []Database  `json:"databases"`
+
+	// files of base backup by part directory
+	baseFiles map[string][]File
+}
+
+type Encryption struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+}
+
+type Database struct {
+	Name     string  `json:"name"`
+	Metadata []File  `json:"metadata"`
+	Tables   []Table `json:"tables"`
+}
+
+type Table struct {
+	Name       string     `json:"name"`
+	Engine     string     `json:"engine"`
+	FreezeTime *time.Time `json:"freeze_time,omitempty"`
+	Partitions []string   `json:"partitions"`
+	Parts      []Part     `json:"parts"`
+}
+
+type Part struct {
+	Name  string `json:"name"`
+	Files []File `json:"files"`
+}
+
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Create new manifest for backup started now
+func New(toolVersion string, buildID string, serverVersion string) *Manifest {
+	return &Manifest{
+		FormatVersion: FormatVersion,
+		ToolVersion:   toolVersion,
+		BuildID:       buildID,
+		ServerVersion: serverVersion,
+		StartTime:     time.Now(),
+	}
+}
+
+// Set previous backup for incremental backup, checksums of files linked from it are not recalculated
+func (m *Manifest) SetBase(baseName string, base *Manifest) {
+	m.IncrementalFrom = baseName
+	m.baseFiles = make(map[string][]File)
+	for _, database := range base.Databases {
+		for _, table := range database.Tables {
+			for _, part := range table.Parts {
+				for _, file := range part.Files {
+					directory := partDirectory(file.Path)
+					m.baseFiles[directory] = append(m.baseFiles[directory], file)
+				}
+			}
+		}
+	}
+}
+
+// Get part directory (partitions/<database>/<table>/<part>) of part file path
+func partDirectory(filePath string) string {
+	names := strings.SplitN(filePath, "/", 5)
+	if len(names) < 5 {
+		return path.Dir(filePath)
+	}
+	return strings.Join(names[:4], "/")
+}
+
+// Record key used for backup files encryption
+func (m *Manifest) SetEncryption(key *crypt.Key) {
+	m.Encryption = &Encryption{
+		Algorithm: crypt.Algorithm,
+		KeyID:     key.ID,
+	}
+}
+
+// Check backup can be decrypted with key, key is nil for not encrypted backup
+func (m *Manifest) CheckEncryption(key *crypt.Key) error {
+	if m.Encryption == nil {
+		if key != nil {
+			return errors.New("backup is not encrypted")
+		}
+		return nil
+	}
+	if key == nil {
+		return fmt.Errorf("backup is encrypted with key %v, set encryption key", m.Encryption.KeyID)
+	}
+	if m.Encryption.KeyID != key.ID {
+		return fmt.Errorf("backup is encrypted with key %v, got key %v", m.Encryption.KeyID, key.ID)
+	}
+	return nil
+}
+
+// Total size of backup files, size from header when databases are not read
+func (m *Manifest) Size() int64 {
+	if m.Databases == nil {
+		return m.TotalSize
+	}
+	var size int64
+	for _, database := range m.Databases {
+		for _, file := range database.Metadata {
+			size += file.Size
+		}
+		for _, table := range database.Tables {
+			for _, part := range table.Parts {
+				for _, file := range part.Files {
+					size += file.Size
+				}
+			}
+		}
+	}
+	return size
+}
+
+// Get database from manifest, add it if not exists
+func (m *Manifest) GetDatabase(databaseName string) *Database {
+	for i := range m.Databases {
+		if m.Databases[i].Name == databaseName {
+			return &m.Databases[i]
+		}
+	}
+	m.Databases = append(m.Databases, Database{Name: databaseName})
+	return &m.Databases[len(m.Databases)-1]
+}
+
+// Get table from database, add it if not exists
+func (db *Database) GetTable(tableName string) *Table {
+	for i := range db.Tables {
+		if db.Tables[i].Name == tableName {
+			return &db.Tables[i]
+		}
+	}
+	db.Tables = append(db.Tables, Table{Name: tableName})
+	return &db.Tables[len(db.Tables)-1]
+}
+
+// Get part of table, add it if not exists
+func (t *Table) GetPart(partName string) *Part {
+	for i := range t.Parts {
+		if t.Parts[i].Name == partName {
+			return &t.Parts[i]
+		}
+	}
+	t.Parts = append(t.Parts, Part{Name: partName})
+	return &t.Parts[len(t.Parts)-1]
+}
+
+// Add tables with engines to manifest
+func (m *Manifest) AddTables(tables []parts.TableDescribe) {
+	for _, table := range tables {
+		m.GetDatabase(table.DatabaseName).GetTable(table.TableName).Engine = table.Engine
+	}
+}
+
+// Add partitions IDs to manifest tables
+func (m *Manifest) AddPartitions(partitions []parts.PartitionDescribe) {
+	for _, partition := range partitions {
+		table := m.GetDatabase(partition.DatabaseName).GetTable(partition.TableName)
+		table.Partitions = append(table.Partitions, partition.PartID)
+	}
+}
+
+// Set freeze time of frozen tables
+func (m *Manifest) AddFreezeTimes(tables []parts.FrozenTable) {
+	for _, table := range tables {
+		freezeTime := table.FreezeTime
+		m.GetDatabase(table.DatabaseName).GetTable(table.TableName).FreezeTime = &freezeTime
+	}
+}
+
+// Collect files with checksums written to backup storage, files of linked directories are taken from base backup
+func (m *Manifest) CollectFiles(recorder *storage.Recorder) {
+	for _, recordedFile := range recorder.Files {
+		m.addFile(File{
+			Path:   recordedFile.Name,
+			Size:   recordedFile.Size,
+			SHA256: recordedFile.SHA256,
+		})
+	}
+
+	for _, linkedDirectory := range recorder.Linked {
+		for _, baseFile := range m.baseFiles[linkedDirectory] {
+			m.addFile(baseFile)
+		}
+	}
+}
+
+// Get database by escaped name of its directory, add it if not exists
+func (m *Manifest) databaseOfDirectory(directory string) *Database {
+	for i := range m.Databases {
+		if fileutils.EscapeForFileName(m.Databases[i].Name) == directory {
+			return &m.Databases[i]
+		}
+	}
+	databaseName, err := url.PathUnescape(directory)
+	if err != nil {
+		databaseName = directory
+	}
+	return m.GetDatabase(databaseName)
+}
+
+// Add file to database metadata or table part by its path, database and table directories are escaped
+func (m *Manifest) addFile(file File) {
+	names := strings.Split(file.Path, "/")
+	if len(names) == 3 && names[0] == "metadata" {
+		database := m.databaseOfDirectory(names[1])
+		database.Metadata = append(database.Metadata, file)
+	} else if len(names) >= 5 && names[0] == "partitions" && names[3] != "detached" {
+		database := m.databaseOfDirectory(names[1])
+		for i := range database.Tables {
+			table := &database.Tables[i]
+			if fileutils.EscapeForFileName(table.Name) == names[2] {
+				part := table.GetPart(names[3])
+				part.Files = append(part.Files, file)
+			}
+		}
+	}
+}
+
+// Write manifest file to backup storage, databases of encrypted backup
+// with file checksums and partitions are written to encrypted file
+func (m *Manifest) Write(destination storage.Storage) error {
+	header := m
+	if m.Encryption != nil {
+		if err := writeJSON(destination, DatabasesFileName, m.Databases); err != nil {
+			return err
+		}
+		header = &Manifest{}
+		*header = *m
+		header.TotalSize = m.Size()
+		header.Databases = nil
+	}
+	return writeJSON(destination, FileName, header)
+}
+
+func writeJSON(destination storage.Storage, name string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.PutBytes(destination, name, content)
+}
+
+// Read manifest file from backup storage, databases of encrypted backup are read
+// from encrypted file, so source must decrypt backup files
+func Read(source storage.Storage) (*Manifest, error) {
+	result, err := readFile(source, FileName)
+	if err != nil || result.Encryption == nil {
+		return result, err
+	}
+
+	content, err := storage.GetBytes(source, DatabasesFileName)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %v, %v", DatabasesFileName, err)
+	}
+	if err = json.Unmarshal(content, &result.Databases); err != nil {
+		return nil, fmt.Errorf("can't read %v, %v", DatabasesFileName, err)
+	}
+	return result, nil
+}
+
+// Read manifest header without databases of encrypted backup, key is not needed
+func ReadHeader(source storage.Storage) (*Manifest, error) {
+	return readFile(source, FileName)
+}
+
+func readFile(source storage.Storage, name string) (*Manifest, error) {
+	var result Manifest
+
+	content, err := storage.GetBytes(source, name)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+type Backup struct {
+	Name string
+	// manifest of backup directory, nil for archives and incomplete backups without manifest
+	Manifest *Manifest
+	Archive  bool
+	Size     int64
+	ModTime  time.Time
+}
+
+// Get backup start time, archives and backups without manifest have modification time
+func (b Backup) StartTime() time.Time {
+	if b.Manifest != nil {
+		return b.Manifest.StartTime
+	}
+	return b.ModTime
+}
+
+// List backup directories and archives in storage directory sorted by start time,
+// only manifests of backup directories are read, files without archive extension
+// (temporary files of running uploads, plans and others) are skipped
+func ListBackups(source storage.Storage) ([]Backup, error) {
+	var result []Backup
+
+	entries, err := source.ListDirectory("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, "/") {
+			if tarball.IsArchiveName(entry.Name) {
+				result = append(result, Backup{
+					Name:    entry.Name,
+					Archive: true,
+					Size:    entry.Size,
+					ModTime: entry.ModTime,
+				})
+			}
+			continue
+		}
+
+		backup := Backup{
+			Name:    strings.TrimSuffix(entry.Name, "/"),
+			ModTime: entry.ModTime,
+		}
+		backup.Manifest, err = readFile(source, path.Join(backup.Name, FileName))
+		if err != nil && !storage.IsNotExist(err) {
+			return nil, fmt.Errorf("can't read %v, %v", path.Join(backup.Name, FileName), err)
+		}
+		result = append(result, backup)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartTime().Before(result[j].StartTime())
+	})
+
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"bytes"
+	"crypt"
+	"fmt"
+	"io/ioutil"
+	"os"
+	parts "partutils"
+	"path"
+	"storage"
+	"strings"
+	"testing"
+)
+
+func TestCollectFilesOfLinkedParts(t *testing.T) {
+	tables := []parts.TableDescribe{{DatabaseName: "db", TableName: "events", Engine: "MergeTree"}}
+
+	base := New("test", "", "")
+	base.AddTables(tables)
+	base.CollectFiles(&storage.Recorder{Files: []storage.RecordedFile{
+		{Name: "metadata/db/events.sql", Size: 10, SHA256: "sql"},
+		{Name: "partitions/db/events/1_1_1_0/checksums.txt", Size: 1, SHA256: "a"},
+		{Name: "partitions/db/events/1_1_1_0/data.bin", Size: 2, SHA256: "b"},
+		{Name: "partitions/db/events/1_1_1_0/p.proj/data.bin", Size: 3, SHA256: "c"},
+		{Name: "partitions/db/events/1_1_1_00/data.bin", Size: 4, SHA256: "d"},
+		{Name: "partitions/db/events/2_2_2_0/data.bin", Size: 5, SHA256: "e"},
+	}})
+
+	incremental := New("test", "", "")
+	incremental.AddTables(tables)
+	incremental.SetBase("base", base)
+	incremental.CollectFiles(&storage.Recorder{
+		Files:  []storage.RecordedFile{{Name: "partitions/db/events/3_3_3_0/data.bin", Size: 6, SHA256: "f"}},
+		Linked: []string{"partitions/db/events/1_1_1_0", "partitions/db/events/2_2_2_0"},
+	})
+
+	expected := []Part{
+		{Name: "3_3_3_0", Files: []File{{"partitions/db/events/3_3_3_0/data.bin", 6, "f"}}},
+		{Name: "1_1_1_0", Files: []File{
+			{"partitions/db/events/1_1_1_0/checksums.txt", 1, "a"},
+			{"partitions/db/events/1_1_1_0/data.bin", 2, "b"},
+			{"partitions/db/events/1_1_1_0/p.proj/data.bin", 3, "c"},
+		}},
+		{Name: "2_2_2_0", Files: []File{{"partitions/db/events/2_2_2_0/data.bin", 5, "e"}}},
+	}
+	got := incremental.GetDatabase("db").GetTable("events").Parts
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got parts %v, expected %v", got, expected)
+	}
+	if metadata := incremental.GetDatabase("db").Metadata; len(metadata) != 0 {
+		t.Errorf("metadata of base backup is collected: %v", metadata)
+	}
+}
+
+func TestCollectFilesOfEscapedNames(t *testing.T) {
+	backupManifest := New("test", "", "")
+	backupManifest.AddTables([]parts.TableDescribe{{DatabaseName: "my-db", TableName: "events.v2", Engine: "MergeTree"}})
+	backupManifest.CollectFiles(&storage.Recorder{Files: []storage.RecordedFile{
+		{Name: "metadata/my%2Ddb/events%2Ev2.sql", Size: 1, SHA256: "a"},
+		{Name: "partitions/my%2Ddb/events%2Ev2/1_1_1_0/data.bin", Size: 2, SHA256: "b"},
+		{Name: "metadata/other%2Ddb/table.sql", Size: 3, SHA256: "c"},
+	}})
+
+	if len(backupManifest.Databases) != 2 || backupManifest.Databases[1].Name != "other-db" {
+		t.Fatalf("got databases %v, expected my-db and other-db", backupManifest.Databases)
+	}
+	database := backupManifest.Databases[0]
+	if len(database.Metadata) != 1 || database.Metadata[0].Path != "metadata/my%2Ddb/events%2Ev2.sql" {
+		t.Errorf("got metadata %v of my-db", database.Metadata)
+	}
+	if parts := database.GetTable("events.v2").Parts; len(parts) != 1 || len(parts[0].Files) != 1 {
+		t.Errorf("got parts %v of my-db.events.v2", parts)
+	}
+}
+
+func TestWriteEncrypted(t *testing.T) {
+	directory, err := ioutil.TempDir("", "manifest_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	key, err := crypt.NewKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := &storage.Local{Directory: directory}
+	encrypted := &storage.Encrypted{Storage: plain, Key: key, PlainFiles: []string{FileName}}
+
+	backupManifest := New("test", "", "")
+	backupManifest.SetEncryption(key)
+	backupManifest.AddTables([]parts.TableDescribe{{DatabaseName: "db", TableName: "events", Engine: "MergeTree"}})
+	backupManifest.AddPartitions([]parts.PartitionDescribe{{DatabaseName: "db", TableName: "events", PartID: "secret_partition"}})
+	backupManifest.CollectFiles(&storage.Recorder{Files: []storage.RecordedFile{
+		{Name: "metadata/db/events.sql", Size: 10, SHA256: "secret_hash"},
+		{Name: "partitions/db/events/1_1_1_0/data.bin", Size: 20, SHA256: "other_hash"},
+	}})
+	if err = backupManifest.Write(encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ioutil.ReadFile(path.Join(directory, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret_hash", "secret_partition", "events"} {
+		if strings.Contains(string(header), secret) {
+			t.Errorf("manifest header contains %v", secret)
+		}
+	}
+
+	readHeader, err := ReadHeader(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readHeader.Size() != 30 || readHeader.Encryption.KeyID != key.ID || readHeader.Databases != nil {
+		t.Errorf("got header %+v", readHeader)
+	}
+	if _, err = Read(plain); err == nil {
+		t.Error("encrypted databases are read without key")
+	}
+
+	readManifest, err := Read(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(readManifest.Databases) != fmt.Sprint(backupManifest.Databases) || readManifest.Size() != 30 {
+		t.Errorf("got databases %v, expected %v", readManifest.Databases, backupManifest.Databases)
+	}
+}
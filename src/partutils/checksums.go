@@ -0,0 +1,256 @@
+package partutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/lib/cityhash102"
+	"github.com/pierrec/lz4"
+)
+
+// Name of clickhouse file with checksums of part files
+const ChecksumsFileName = "checksums.txt"
+
+type PartFileChecksum struct {
+	FileName         string
+	FileSize         uint64
+	FileHash         cityhash102.Uint128
+	IsCompressed     bool
+	UncompressedSize uint64
+}
+
+// Size of blocks hashed by clickhouse HashingWriteBuffer
+const hashingBlockSize = 2048
+
+// Writer calculating CityHash128 of file content as clickhouse does for checksums.txt,
+// hash of every full block is seed of next block hash and last incomplete block is hashed on Sum
+type FileHash struct {
+	block []byte
+	hash  cityhash102.Uint128
+}
+
+func (fh *FileHash) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		if fh.block == nil {
+			fh.block = make([]byte, 0, hashingBlockSize)
+		}
+		length := hashingBlockSize - len(fh.block)
+		if length > len(data) {
+			length = len(data)
+		}
+		fh.block = append(fh.block, data[:length]...)
+		data = data[length:]
+		if len(fh.block) == hashingBlockSize {
+			fh.hash = cityhash102.CityHash128WithSeed(fh.block, hashingBlockSize, fh.hash)
+			fh.block = fh.block[:0]
+		}
+	}
+	return written, nil
+}
+
+// Get hash of written content
+func (fh *FileHash) Sum() cityhash102.Uint128 {
+	return cityhash102.CityHash128WithSeed(fh.block, uint32(len(fh.block)), fh.hash)
+}
+
+// Compression methods of clickhouse compressed blocks
+const (
+	compressionMethodNone = 0x02
+	compressionMethodLZ4  = 0x82
+	compressionMethodZSTD = 0x90
+)
+
+// Read checksums.txt from part directory
+func ReadPartChecksums(partDirectory string) ([]PartFileChecksum, error) {
+	content, err := ioutil.ReadFile(path.Join(partDirectory, ChecksumsFileName))
+	if err != nil {
+		return nil, err
+	}
+	return ParsePartChecksums(content)
+}
+
+// Parse checksums.txt content (supported format versions 2, 3 and 4 with LZ4)
+func ParsePartChecksums(content []byte) ([]PartFileChecksum, error) {
+	reader := bufio.NewReader(bytes.NewReader(content))
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(header, "checksums format version: ") {
+		return nil, fmt.Errorf("unknown checksums header %q", header)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "checksums format version: ")))
+	if err != nil {
+		return nil, err
+	}
+
+	switch version {
+	case 2:
+		return readTextChecksums(reader)
+	case 3:
+		return readBinaryChecksums(reader)
+	case 4:
+		data, err := decompressBlocks(reader)
+		if err != nil {
+			return nil, err
+		}
+		return readBinaryChecksums(bufio.NewReader(bytes.NewReader(data)))
+	}
+
+	return nil, fmt.Errorf("unsupported checksums format version %v", version)
+}
+
+// Read text checksums (format version 2)
+func readTextChecksums(reader *bufio.Reader) ([]PartFileChecksum, error) {
+	var (
+		result     []PartFileChecksum
+		filesCount int
+	)
+
+	if _, err := fmt.Fscanf(reader, "%d files:\n", &filesCount); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < filesCount; i++ {
+		var (
+			item              PartFileChecksum
+			hashLow, hashHigh uint64
+			compressed        int
+		)
+
+		fileName, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		item.FileName = strings.TrimSuffix(fileName, "\n")
+
+		if _, err = fmt.Fscanf(reader, "\tsize: %d\n\thash: %d %d\n\tcompressed: %d\n",
+			&item.FileSize, &hashLow, &hashHigh, &compressed); err != nil {
+			return nil, err
+		}
+		item.FileHash = cityhash102.Uint128{hashLow, hashHigh}
+		if compressed == 1 {
+			item.IsCompressed = true
+			if _, err = fmt.Fscanf(reader, "\tuncompressed size: %d\n\tuncompressed hash: %d %d\n",
+				&item.UncompressedSize, &hashLow, &hashHigh); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// Read binary checksums (format version 3)
+func readBinaryChecksums(reader *bufio.Reader) ([]PartFileChecksum, error) {
+	var result []PartFileChecksum
+
+	filesCount, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := make([]byte, 16)
+	for i := uint64(0); i < filesCount; i++ {
+		var item PartFileChecksum
+
+		nameLength, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLength)
+		if _, err = io.ReadFull(reader, name); err != nil {
+			return nil, err
+		}
+		item.FileName = string(name)
+
+		if item.FileSize, err = binary.ReadUvarint(reader); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(reader, hash); err != nil {
+			return nil, err
+		}
+		item.FileHash = cityhash102.Uint128{binary.LittleEndian.Uint64(hash), binary.LittleEndian.Uint64(hash[8:])}
+		compressed, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if compressed != 0 {
+			item.IsCompressed = true
+			if item.UncompressedSize, err = binary.ReadUvarint(reader); err != nil {
+				return nil, err
+			}
+			if _, err = io.ReadFull(reader, hash); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// Decompress sequence of clickhouse compressed blocks
+func decompressBlocks(reader io.Reader) ([]byte, error) {
+	var result []byte
+
+	for {
+		// block checksum (16 bytes) and header: method, compressed size and decompressed size
+		header := make([]byte, 16+9)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return nil, err
+		}
+		method := header[16]
+		compressedSize := binary.LittleEndian.Uint32(header[17:21])
+		decompressedSize := binary.LittleEndian.Uint32(header[21:25])
+		if compressedSize < 9 {
+			return nil, errors.New("broken compressed block header")
+		}
+
+		data := make([]byte, compressedSize-9)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+
+		switch method {
+		case compressionMethodNone:
+			result = append(result, data...)
+		case compressionMethodLZ4:
+			block, err := decompressLZ4Block(data, int(decompressedSize))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, block...)
+		case compressionMethodZSTD:
+			return nil, errors.New("ZSTD compressed checksums are not supported")
+		default:
+			return nil, fmt.Errorf("unknown compression method 0x%x", method)
+		}
+	}
+}
+
+// Decompress single LZ4 block of known decompressed size
+func decompressLZ4Block(source []byte, decompressedSize int) ([]byte, error) {
+	result := make([]byte, decompressedSize)
+	length, err := lz4.UncompressBlock(source, result)
+	if err != nil {
+		return nil, fmt.Errorf("broken LZ4 block, %v", err)
+	}
+	if length != decompressedSize {
+		return nil, errors.New("broken LZ4 block: wrong decompressed size")
+	}
+	return result, nil
+}
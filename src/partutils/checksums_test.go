@@ -0,0 +1,219 @@
+package partutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/lib/cityhash102"
+)
+
+// Checksums of columns.txt, count.txt, id.bin, id.mrk2, name.bin and name.mrk2 in binary format (version 3)
+const testBinaryChecksums = "060b636f6c756d6e732e74787464000102030405060708090a0b0c0d0e0f0009636f756e742e74787402000102030405060708090a0b0c0d0e0f000669642e62696ee0a712000102030405060708090a0b0c0d0e0f0180ea30101112131415161718191a1b1c1d1e1f0769642e6d726b32f001000102030405060708090a0b0c0d0e0f00086e616d652e62696ef09309000102030405060708090a0b0c0d0e0f01c0843d101112131415161718191a1b1c1d1e1f096e616d652e6d726b32f001000102030405060708090a0b0c0d0e0f00"
+
+// Binary checksums compressed to LZ4 block by lz4 tool
+const testLZ4Checksums = "f016060b636f6c756d6e732e74787464000102030405060708090a0b0c0d0e0f0009636f756e741c001d021c00ac0669642e62696ee0a7121b00fc0f0180ea30101112131415161718191a1b1c1d1e1f0769642e6d726b32f0012e006000086e616d654b003cf093091d004c01c0843d4b00110930000e4d00500c0d0e0f00"
+
+const testTextChecksums = `checksums format version: 2
+6 files:
+columns.txt
+	size: 100
+	hash: 506097522914230528 1084818905618843912
+	compressed: 0
+count.txt
+	size: 2
+	hash: 506097522914230528 1084818905618843912
+	compressed: 0
+id.bin
+	size: 300000
+	hash: 506097522914230528 1084818905618843912
+	compressed: 1
+	uncompressed size: 800000
+	uncompressed hash: 3 4
+id.mrk2
+	size: 240
+	hash: 506097522914230528 1084818905618843912
+	compressed: 0
+name.bin
+	size: 150000
+	hash: 506097522914230528 1084818905618843912
+	compressed: 1
+	uncompressed size: 1000000
+	uncompressed hash: 3 4
+name.mrk2
+	size: 240
+	hash: 506097522914230528 1084818905618843912
+	compressed: 0
+`
+
+// Hash 000102...0f of binary checksums
+var testFileHash = cityhash102.Uint128{0x0706050403020100, 0x0f0e0d0c0b0a0908}
+
+var testChecksums = []PartFileChecksum{
+	{"columns.txt", 100, testFileHash, false, 0},
+	{"count.txt", 2, testFileHash, false, 0},
+	{"id.bin", 300000, testFileHash, true, 800000},
+	{"id.mrk2", 240, testFileHash, false, 0},
+	{"name.bin", 150000, testFileHash, true, 1000000},
+	{"name.mrk2", 240, testFileHash, false, 0},
+}
+
+func mustDecodeHex(value string) []byte {
+	result, err := hex.DecodeString(value)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// Make clickhouse compressed block with zero checksum
+func compressedBlock(method byte, data []byte, decompressedSize int) []byte {
+	header := make([]byte, 16+9)
+	header[16] = method
+	binary.LittleEndian.PutUint32(header[17:21], uint32(len(data)+9))
+	binary.LittleEndian.PutUint32(header[21:25], uint32(decompressedSize))
+	return append(header, data...)
+}
+
+func concat(values ...[]byte) []byte {
+	return bytes.Join(values, nil)
+}
+
+func TestParsePartChecksums(t *testing.T) {
+	binaryChecksums := mustDecodeHex(testBinaryChecksums)
+	lz4Checksums := mustDecodeHex(testLZ4Checksums)
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"text", []byte(testTextChecksums)},
+		{"binary", concat([]byte("checksums format version: 3\n"), binaryChecksums)},
+		{"LZ4 compressed", concat([]byte("checksums format version: 4\n"),
+			compressedBlock(compressionMethodLZ4, lz4Checksums, len(binaryChecksums)))},
+		{"not compressed block", concat([]byte("checksums format version: 4\n"),
+			compressedBlock(compressionMethodNone, binaryChecksums, len(binaryChecksums)))},
+		{"several blocks", concat([]byte("checksums format version: 4\n"),
+			compressedBlock(compressionMethodNone, binaryChecksums[:50], 50),
+			compressedBlock(compressionMethodNone, binaryChecksums[50:], len(binaryChecksums)-50))},
+	}
+
+	for _, test := range tests {
+		checksums, err := ParsePartChecksums(test.content)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if fmt.Sprint(checksums) != fmt.Sprint(testChecksums) {
+			t.Errorf("%v: got %v, expected %v", test.name, checksums, testChecksums)
+		}
+	}
+}
+
+func TestParsePartChecksumsErrors(t *testing.T) {
+	binaryChecksums := mustDecodeHex(testBinaryChecksums)
+	lz4Checksums := mustDecodeHex(testLZ4Checksums)
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"unknown header", []byte("checksums version: 3\n")},
+		{"unsupported version", []byte("checksums format version: 5\n")},
+		{"truncated text", []byte(testTextChecksums[:len(testTextChecksums)-40])},
+		{"truncated binary", concat([]byte("checksums format version: 3\n"), binaryChecksums[:100])},
+		{"ZSTD compressed", concat([]byte("checksums format version: 4\n"),
+			compressedBlock(compressionMethodZSTD, lz4Checksums, len(binaryChecksums)))},
+		{"unknown compression", concat([]byte("checksums format version: 4\n"),
+			compressedBlock(0x91, lz4Checksums, len(binaryChecksums)))},
+		{"truncated block", concat([]byte("checksums format version: 4\n"),
+			compressedBlock(compressionMethodLZ4, lz4Checksums, len(binaryChecksums))[:100])},
+		{"wrong decompressed size", concat([]byte("checksums format version: 4\n"),
+			compressedBlock(compressionMethodLZ4, lz4Checksums, len(binaryChecksums)+1))},
+	}
+
+	for _, test := range tests {
+		if checksums, err := ParsePartChecksums(test.content); err == nil {
+			t.Errorf("%v: got %v without error", test.name, checksums)
+		}
+	}
+}
+
+func TestDecompressLZ4Block(t *testing.T) {
+	binaryChecksums := mustDecodeHex(testBinaryChecksums)
+	lz4Checksums := mustDecodeHex(testLZ4Checksums)
+
+	tests := []struct {
+		name   string
+		source []byte
+		result string
+	}{
+		{"literals only", []byte("\x50hello"), "hello"},
+		// 15 + 5 literals with length byte
+		{"long literals", []byte("\xf0\x05abcdefghijklmnopqrst"), "abcdefghijklmnopqrst"},
+		// overlapping match copies repeated byte
+		{"overlapping match", []byte("\x13a\x01\x00\x50bcdef"), "aaaaaaaabcdef"},
+	}
+
+	for _, test := range tests {
+		result, err := decompressLZ4Block(test.source, len(test.result))
+		if err != nil || string(result) != test.result {
+			t.Errorf("%v: got %q (%v), expected %q", test.name, result, err, test.result)
+		}
+	}
+
+	result, err := decompressLZ4Block(lz4Checksums, len(binaryChecksums))
+	if err != nil || !bytes.Equal(result, binaryChecksums) {
+		t.Errorf("lz4 tool block: got %x (%v)", result, err)
+	}
+
+	for _, source := range [][]byte{
+		[]byte("\xf0"),
+		[]byte("\x50hel"),
+		[]byte("\x10a\x05"),
+		[]byte("\x10a\x05\x00"),
+		[]byte("\x10a\x00\x00"),
+	} {
+		if result, err := decompressLZ4Block(source, 10); err == nil {
+			t.Errorf("%x: got %q without error", source, result)
+		}
+	}
+}
+
+func TestFileHash(t *testing.T) {
+	content := make([]byte, 2*hashingBlockSize+100)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	// every full block hash is seed of next block hash
+	var expected cityhash102.Uint128
+	expected = cityhash102.CityHash128WithSeed(content, hashingBlockSize, expected)
+	expected = cityhash102.CityHash128WithSeed(content[hashingBlockSize:], hashingBlockSize, expected)
+	expected = cityhash102.CityHash128WithSeed(content[2*hashingBlockSize:], 100, expected)
+
+	for _, chunkSize := range []int{1, 100, hashingBlockSize, len(content)} {
+		var fileHash FileHash
+		for start := 0; start < len(content); start += chunkSize {
+			end := start + chunkSize
+			if end > len(content) {
+				end = len(content)
+			}
+			fileHash.Write(content[start:end])
+		}
+		if hash := fileHash.Sum(); hash != expected {
+			t.Errorf("chunks of %v bytes: got %x, expected %x", chunkSize, hash, expected)
+		}
+	}
+
+	// last block of content with size of full blocks is empty
+	var fileHash FileHash
+	fileHash.Write(content[:hashingBlockSize])
+	expected = cityhash102.CityHash128WithSeed(nil, 0, cityhash102.CityHash128WithSeed(content, hashingBlockSize, cityhash102.Uint128{}))
+	if hash := fileHash.Sum(); hash != expected {
+		t.Errorf("full block: got %x, expected %x", hash, expected)
+	}
+}
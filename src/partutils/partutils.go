@@ -1,13 +1,19 @@
 package partutils
 
 import (
+	"context"
 	"fileutils"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"io/ioutil"
 	logs "logging"
-	"os"
+	"net/url"
+	"path"
+	"regexp"
+	"storage"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PartitionDescribe struct {
@@ -16,53 +22,219 @@ type PartitionDescribe struct {
 	PartID       string
 }
 
+// Names of database and table are escaped names of their directories
 type GetPartitionsListFromDir struct {
-	SourceDirectory      string
+	Source               storage.Storage
 	DestinationDirectory string
 	DatabaseName         string
+	TargetDatabaseName   string
 	TableName            string
+	MoveFlag             bool
+	DryRunFlag           bool
+	Partitions           PartitionFilter
+	SkipParts            map[string]bool
 	Result               []PartitionDescribe
 }
 
+// Partition IDs matched by glob patterns or inclusive range, empty filter matches all partitions
+type PartitionFilter struct {
+	IDs  []string
+	From string
+	To   string
+}
+
+type TableDescribe struct {
+	DatabaseName string
+	TableName    string
+	Engine       string
+}
+
+type GetTables struct {
+	Database string
+	Filter   TableFilter
+	Result   []TableDescribe
+}
+
+type GetParts struct {
+	Database string
+	Table    string
+	Result   []string
+}
+
 type GetPartitions struct {
 	Database string
+	Filter   TableFilter
 	Result   []PartitionDescribe
 }
 
+// Failed table or other object, error has partition or part context
+type Failure struct {
+	Object string
+	Err    error
+}
+
+// Failures of objects skipped by continue on error policy, safe for concurrent use
+type Failures struct {
+	mutex sync.Mutex
+	List  []Failure
+}
+
+// Record failed object
+func (f *Failures) Add(object string, err error) {
+	logs.Error.Printf("%v failed, %v", object, err)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.List = append(f.List, Failure{Object: object, Err: err})
+}
+
+// Check object failed
+func (f *Failures) Has(object string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, failure := range f.List {
+		if failure.Object == object {
+			return true
+		}
+	}
+	return false
+}
+
+// Glob patterns for database.table names, empty Include matches all tables
+type TableFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Check partition ID is matched by patterns and range, IDs in range are compared as strings
+func (pf PartitionFilter) Match(partitionID string) bool {
+	if pf.From != "" && partitionID < pf.From {
+		return false
+	}
+	if pf.To != "" && partitionID > pf.To {
+		return false
+	}
+	if len(pf.IDs) == 0 {
+		return true
+	}
+	for _, pattern := range pf.IDs {
+		if matched, _ := path.Match(pattern, partitionID); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Check filter selects partitions
+func (pf PartitionFilter) IsEmpty() bool {
+	return len(pf.IDs) == 0 && pf.From == "" && pf.To == ""
+}
+
+// Get partition ID from part name (<partition>_<min block>_<max block>_<level>[_<mutation>])
+func PartitionOfPart(partName string) string {
+	return strings.SplitN(partName, "_", 2)[0]
+}
+
+// Freeze modes: whole table in one query or every partition
+const (
+	FreezeModeTable     = "table"
+	FreezeModePartition = "partition"
+)
+
+type FrozenTable struct {
+	DatabaseName string
+	TableName    string
+	FreezeTime   time.Time
+}
+
 type FreezePartitions struct {
-	Partitions           []PartitionDescribe
-	SourceDirectory      string
-	DestinationDirectory string
-	NoFreezeFlag         bool
+	Mode              string
+	ShadowName        string
+	Tables            []TableDescribe
+	Partitions        []PartitionDescribe
+	SourceDirectory   string
+	Destination       storage.Storage
+	PreviousDirectory string
+	NoFreezeFlag      bool
+	Filter            TableFilter
+	Parallel          int
+	PerDiskParallel   int
+	ContinueOnError   bool
+	Result            []FrozenTable
+	Failed            Failures
+	disks             map[uint64]chan struct{}
+	disksMutex        sync.Mutex
+}
+
+// Get list of tables with engines for database
+func (gt *GetTables) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
+
+	var (
+		err    error
+		tables []struct {
+			Name     string `db:"name"`
+			Engine   string `db:"engine"`
+			Database string `db:"database"`
+		}
+	)
+
+	err = databaseConnection.SelectContext(ctx, &tables,
+		fmt.Sprintf("select "+
+			"name, "+
+			"engine, "+
+			"database "+
+			"FROM system.tables WHERE database ='%v';", gt.Database))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range tables {
+		if !strings.HasPrefix(item.Name, ".") && gt.Filter.Match(item.Database, item.Name) {
+			gt.Result = append(gt.Result, TableDescribe{
+				DatabaseName: item.Database,
+				TableName:    item.Name,
+				Engine:       item.Engine,
+			})
+		}
+	}
+
+	return nil
+
+}
+
+// Get names of active parts of table
+func (gp *GetParts) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
+	return databaseConnection.SelectContext(ctx, &gp.Result,
+		fmt.Sprintf("select name FROM system.parts WHERE active AND database ='%v' AND table ='%v';", gp.Database, gp.Table))
 }
 
-// Get list of partitions for tables
-func (gp *GetPartitions) Run(databaseConnection *sqlx.DB) error {
+// Get list of partition IDs for MergeTree family tables, IDs are prefixes of part names matched by PartitionFilter
+func (gp *GetPartitions) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
 
 	var (
 		err        error
 		partitions []struct {
-			Partition string `db:"partition"`
-			Table     string `db:"table"`
-			Database  string `db:"database"`
+			PartitionID string `db:"partition_id"`
+			Table       string `db:"table"`
+			Database    string `db:"database"`
 		}
 	)
 
-	err = databaseConnection.Select(&partitions,
+	err = databaseConnection.SelectContext(ctx, &partitions,
 		fmt.Sprintf("select "+
-			"DISTINCT partition, "+
+			"DISTINCT partition_id, "+
 			"table, "+
 			"database "+
-			"FROM system.parts WHERE active AND database ='%v';", gp.Database))
+			"FROM system.parts WHERE active AND database ='%v' AND table IN ("+
+			"SELECT name FROM system.tables WHERE database ='%v' AND engine LIKE '%%MergeTree');", gp.Database, gp.Database))
 	if err != nil {
 		return err
 	}
 
 	for _, item := range partitions {
-		if !strings.HasPrefix(item.Table, ".") {
-			logs.Info.Printf("found %v partition of %v table in %v database", item.Partition, item.Table, item.Database)
+		if !strings.HasPrefix(item.Table, ".") && gp.Filter.Match(item.Database, item.Table) {
+			logs.Info.Printf("found %v partition of %v table in %v database", item.PartitionID, item.Table, item.Database)
 			gp.Result = append(gp.Result, PartitionDescribe{
-				PartID:       item.Partition,
+				PartID:       item.PartitionID,
 				TableName:    item.Table,
 				DatabaseName: item.Database,
 			})
@@ -84,46 +256,74 @@ func IsPartExists(currentPartitions []PartitionDescribe, newPart PartitionDescri
 	return false
 }
 
-// Get partition list from directory with parts
-func (gl *GetPartitionsListFromDir) Run() error {
+// Get name of database parts are attached to, parts are attached to backup database by default
+func (gl *GetPartitionsListFromDir) targetDatabase() string {
+	if gl.TargetDatabaseName == "" {
+		return gl.DatabaseName
+	}
+	return gl.TargetDatabaseName
+}
+
+// Get partition list from backup storage with parts and copy parts to detached directory
+func (gl *GetPartitionsListFromDir) Run(ctx context.Context) error {
 	var (
-		err     error
-		partsFD []os.FileInfo
-		result  []PartitionDescribe
+		err       error
+		files     []storage.FileInfo
+		partNames []string
+		result    []PartitionDescribe
 	)
 
-	logs.Info.Println(gl.SourceDirectory + "/partitions/" + gl.DatabaseName + "/" + gl.TableName)
-	if partsFD, err = ioutil.ReadDir(gl.SourceDirectory + "/partitions/" + gl.DatabaseName + "/" + gl.TableName); err != nil {
-		logs.Info.Println(err)
+	tableName := "partitions/" + gl.DatabaseName + "/" + gl.TableName
+	logs.Info.Println(tableName)
+	if files, err = gl.Source.List(tableName + "/"); err != nil {
+		return err
+	}
+	for _, file := range files {
+		names := strings.Split(strings.TrimPrefix(file.Name, tableName+"/"), "/")
+		if len(names) < 2 || names[0] == "detached" || !gl.Partitions.Match(PartitionOfPart(names[0])) {
+			continue
+		}
+		if len(partNames) == 0 || partNames[len(partNames)-1] != names[0] {
+			partNames = append(partNames, names[0])
+		}
 	}
-	for _, partDescriptor := range partsFD {
-		if partDescriptor.IsDir() && partDescriptor.Name() != "detached" {
 
+	for _, partName := range partNames {
+		if gl.SkipParts[partName] {
+			logs.Info.Printf("skip part %v existing in table %v", partName, gl.TableName)
+			continue
+		}
+		sourcePart := tableName + "/" + partName
+		destinationPart := gl.DestinationDirectory + "/data/" + gl.targetDatabase() + "/" + gl.TableName + "/detached/" + partName
+
+		if gl.DryRunFlag {
+			logs.Info.Printf("skip copy of partition from %v to %v in dry run", sourcePart, destinationPart)
+		} else if local, ok := gl.Source.(*storage.Local); ok && gl.MoveFlag {
+			// move partition files to detached directory
+			logs.Info.Printf("move partition from %v to %v", local.Directory+"/"+sourcePart, destinationPart)
+			err = fileutils.MoveDirectory(ctx, local.Directory+"/"+sourcePart, destinationPart)
+		} else {
 			// copy partition files to detached  directory
-			logs.Info.Printf("copy partition from %v to %v",
-				gl.SourceDirectory+"/partitions/"+gl.DatabaseName+"/"+gl.TableName,
-				gl.DestinationDirectory+"/data/"+gl.DatabaseName+"/"+gl.TableName+"/detached")
-			err = fileutils.CopyDirectory(
-				gl.SourceDirectory+"/partitions/"+gl.DatabaseName+"/"+gl.TableName,
-				gl.DestinationDirectory+"/data/"+gl.DatabaseName+"/"+gl.TableName+"/detached")
-			if err != nil {
-				gl.Result = result
-				return err
-			}
-			// append partition to result part list
-			if !IsPartExists(result,
+			logs.Info.Printf("copy partition from %v to %v", sourcePart, destinationPart)
+			err = storage.GetDirectory(ctx, gl.Source, sourcePart, destinationPart)
+		}
+		if err != nil {
+			gl.Result = result
+			return err
+		}
+		// append partition to result part list
+		if !IsPartExists(result,
+			PartitionDescribe{
+				DatabaseName: gl.targetDatabase(),
+				TableName:    gl.TableName,
+				PartID:       partName,
+			}) {
+			result = append(result,
 				PartitionDescribe{
-					DatabaseName: gl.DatabaseName,
+					DatabaseName: gl.targetDatabase(),
 					TableName:    gl.TableName,
-					PartID:       partDescriptor.Name(),
-				}) {
-				result = append(result,
-					PartitionDescribe{
-						DatabaseName: gl.DatabaseName,
-						TableName:    gl.TableName,
-						PartID:       partDescriptor.Name(),
-					})
-			}
+					PartID:       partName,
+				})
 		}
 	}
 
@@ -132,79 +332,397 @@ func (gl *GetPartitionsListFromDir) Run() error {
 
 }
 
-// Freeze partitions and create hardlink in $CLICKHOUSE_DIRECTORY/shadow
-func (fz *FreezePartitions) Run(databaseConnection *sqlx.DB) error {
-	for _, partition := range fz.Partitions {
-		if fz.NoFreezeFlag {
-			logs.Info.Printf("ALTER TABLE %v.%v FREEZE PARTITION %v WITH NAME 'backup';",
-				partition.DatabaseName,
-				partition.TableName,
-				partition.PartID,
-			)
-		} else {
-			// freeze partitions
-			_, err := databaseConnection.Exec(
-				fmt.Sprintf(
-					"ALTER TABLE %v.%v FREEZE PARTITION %v WITH NAME 'backup';",
-					partition.DatabaseName,
-					partition.TableName,
-					partition.PartID,
-				))
-			if err != nil {
-				return err
-			}
+// Check table engine is MergeTree family engine (MergeTree, ReplicatedMergeTree, ReplacingMergeTree...)
+func IsMergeTree(engine string) bool {
+	return strings.HasSuffix(engine, "MergeTree")
+}
 
-			// copy partition files and metadata
-			inDirectory := fz.SourceDirectory
-			outDirectory := fz.DestinationDirectory
+// Add database name to list once
+func appendDatabase(databases []string, databaseName string) []string {
+	for _, name := range databases {
+		if name == databaseName {
+			return databases
+		}
+	}
+	return append(databases, databaseName)
+}
+
+// Partitions of one table, table is frozen and copied by one worker
+type tableJob struct {
+	databaseName string
+	tableName    string
+	partitions   []PartitionDescribe
+	freezeTime   time.Time
+	failed       bool
+}
+
+// Group partitions by tables in order of partitions list
+func groupByTables(partitions []PartitionDescribe) []*tableJob {
+	var jobs []*tableJob
+	tables := make(map[string]*tableJob)
+	for _, partition := range partitions {
+		key := partition.DatabaseName + "." + partition.TableName
+		job, ok := tables[key]
+		if !ok {
+			job = &tableJob{databaseName: partition.DatabaseName, tableName: partition.TableName}
+			tables[key] = job
+			jobs = append(jobs, job)
+		}
+		job.partitions = append(job.partitions, partition)
+	}
+	return jobs
+}
+
+// Freeze tables and create hardlink in $CLICKHOUSE_DIRECTORY/shadow/$ShadowName,
+// only metadata of tables with other engines (Kafka, Distributed, View...) is copied.
+// In table mode all tables are frozen first for consistent snapshot and copied after,
+// in partition mode every table is copied after freeze of its partitions.
+// Tables are processed by Parallel workers, PerDiskParallel limits copying workers on one disk
+func (fz *FreezePartitions) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
+	var (
+		err       error
+		databases []string
+	)
 
-			directoryList := []string{
-				outDirectory + "/partitions",
-				outDirectory + "/partitions/" + partition.DatabaseName,
-				outDirectory + "/metadata",
-				outDirectory + "/metadata/" + partition.DatabaseName,
+	for _, table := range fz.Tables {
+		if !IsMergeTree(table.Engine) {
+			logs.Info.Printf("copy only schema of %v table in %v database with %v engine", table.TableName, table.DatabaseName, table.Engine)
+		}
+		databases = appendDatabase(databases, table.DatabaseName)
+	}
+
+	jobs := groupByTables(fz.Partitions)
+	if fz.NoFreezeFlag {
+		for _, job := range jobs {
+			for _, query := range fz.freezeQueries(job) {
+				logs.Info.Println(query)
 			}
+		}
+		return nil
+	}
+	for _, job := range jobs {
+		databases = appendDatabase(databases, job.databaseName)
+	}
 
-			err, failDirectory := fileutils.CreateDirectories(directoryList)
-			if err != nil {
-				logs.Error.Printf("can't create directory: %v", failDirectory)
+	freezeTable := func(job *tableJob) error {
+		return fz.freezeTable(ctx, databaseConnection, job)
+	}
+	copyTable := func(job *tableJob) error {
+		return fz.copyTable(ctx, job)
+	}
+	if fz.Mode == FreezeModePartition {
+		err = fz.runJobs(ctx, jobs, func(job *tableJob) error {
+			if err := freezeTable(job); err != nil {
 				return err
 			}
+			return copyTable(job)
+		})
+	} else {
+		err = fz.runJobs(ctx, jobs, freezeTable)
+		if err == nil {
+			err = fz.runJobs(ctx, jobs, copyTable)
+		}
+	}
+	for _, job := range jobs {
+		if !job.freezeTime.IsZero() && !job.failed {
+			fz.Result = append(fz.Result, FrozenTable{
+				DatabaseName: job.databaseName,
+				TableName:    job.tableName,
+				FreezeTime:   job.freezeTime,
+			})
+		}
+	}
+	if err != nil {
+		return err
+	}
 
-			// copy partition files
-			logs.Info.Printf("copy data from %v to %v",
-				inDirectory+"/shadow/backup/data/"+partition.DatabaseName,
-				outDirectory+"/partitions/"+partition.DatabaseName)
-			err = fileutils.CopyDirectory(
-				inDirectory+"/shadow/backup/data/"+partition.DatabaseName,
-				outDirectory+"/partitions/"+partition.DatabaseName)
-			if err != nil {
-				return err
+	// copy metadata of all tables except failed, databases without MergeTree tables are backed up as schema only
+	for _, databaseName := range databases {
+		databaseDirectory := fileutils.EscapeForFileName(databaseName)
+		logs.Info.Printf("copy data from %v to %v",
+			fz.SourceDirectory+"/metadata/"+databaseDirectory,
+			"metadata/"+databaseDirectory)
+		databaseName := databaseName
+		err = CopyMetadata(ctx, fz.SourceDirectory+"/metadata/"+databaseDirectory, fz.Destination, "metadata/"+databaseDirectory, func(fileName string) bool {
+			return fz.Filter.MatchFile(databaseName, fileName) && !fz.Failed.Has(databaseName+"."+TableOfFile(fileName))
+		})
+		if err != nil && fz.ContinueOnError && ctx.Err() == nil {
+			fz.Failed.Add("metadata of "+databaseName, err)
+		} else if err != nil {
+			return fmt.Errorf("metadata of %v: %v", databaseName, err)
+		}
+	}
+
+	return nil
+
+}
+
+// Run jobs by workers, jobs are not started after first error or context cancel,
+// with ContinueOnError failed tables are recorded and skipped in next runs
+func (fz *FreezePartitions) runJobs(ctx context.Context, jobs []*tableJob, work func(job *tableJob) error) error {
+	var (
+		wait     sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+		queue    = make(chan *tableJob)
+	)
+
+	workers := fz.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for job := range queue {
+				mutex.Lock()
+				failed := firstErr != nil
+				mutex.Unlock()
+				if failed || job.failed {
+					continue
+				}
+				err := ctx.Err()
+				if err == nil {
+					err = work(job)
+				}
+				if err != nil && fz.ContinueOnError && ctx.Err() == nil {
+					fz.Failed.Add(job.databaseName+"."+job.tableName, err)
+					job.failed = true
+				} else if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("%v.%v: %v", job.databaseName, job.tableName, err)
+					}
+					mutex.Unlock()
+				}
 			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wait.Wait()
 
-			// copy metadata files
-			logs.Info.Printf("copy data from %v to %v",
-				inDirectory+"/metadata/"+partition.DatabaseName,
-				outDirectory+"/metadata/"+partition.DatabaseName)
-			err = fileutils.CopyDirectory(
-				inDirectory+"/metadata/"+partition.DatabaseName,
-				outDirectory+"/metadata/"+partition.DatabaseName)
-			if err != nil {
-				return err
+	return firstErr
+}
+
+// Get freeze queries of table, whole table is frozen in table mode,
+// partitions are frozen by ID because values of tuple and string keys need quoting
+func (fz *FreezePartitions) freezeQueries(job *tableJob) []string {
+	if fz.Mode != FreezeModePartition {
+		return []string{fmt.Sprintf("ALTER TABLE %v.%v FREEZE WITH NAME '%v';", QuoteName(job.databaseName), QuoteName(job.tableName), fz.ShadowName)}
+	}
+
+	var queries []string
+	for _, partition := range job.partitions {
+		queries = append(queries, fmt.Sprintf(
+			"ALTER TABLE %v.%v FREEZE PARTITION ID '%v' WITH NAME '%v';",
+			QuoteName(partition.DatabaseName),
+			QuoteName(partition.TableName),
+			partition.PartID,
+			fz.ShadowName,
+		))
+	}
+	return queries
+}
+
+// Freeze table or its partitions, freeze time of table is start of first query
+func (fz *FreezePartitions) freezeTable(ctx context.Context, databaseConnection *sqlx.DB, job *tableJob) error {
+	freezeTime := time.Now()
+	for i, query := range fz.freezeQueries(job) {
+		logs.Info.Println(query)
+		if _, err := databaseConnection.ExecContext(ctx, query); err != nil {
+			if fz.Mode == FreezeModePartition {
+				return fmt.Errorf("can't freeze partition %v, %v", job.partitions[i].PartID, err)
 			}
+			return fmt.Errorf("can't freeze, %v", err)
+		}
+	}
+	job.freezeTime = freezeTime
+	return nil
+}
+
+// Copy frozen parts of table once
+func (fz *FreezePartitions) copyTable(ctx context.Context, job *tableJob) error {
+	tableDirectory := fileutils.EscapeForFileName(job.databaseName) + "/" + fileutils.EscapeForFileName(job.tableName)
+
+	release := fz.acquireDisk(fz.SourceDirectory + "/data/" + tableDirectory)
+	defer release()
+
+	logs.Info.Printf("copy data from %v to %v",
+		fz.SourceDirectory+"/shadow/"+fz.ShadowName+"/data/"+tableDirectory,
+		"partitions/"+tableDirectory)
+	previousDirectory := ""
+	if fz.PreviousDirectory != "" {
+		previousDirectory = fz.PreviousDirectory + "/partitions/" + tableDirectory
+	}
+	err := CopyTableParts(
+		ctx,
+		fz.SourceDirectory+"/shadow/"+fz.ShadowName+"/data/"+tableDirectory,
+		fz.Destination,
+		"partitions/"+tableDirectory,
+		previousDirectory)
+	if err != nil && fz.ContinueOnError {
+		// parts of failed table are not kept in backup when storage can delete them
+		if deleteErr := fz.Destination.Delete("partitions/" + tableDirectory); deleteErr != nil && deleteErr != storage.ErrNotSupported {
+			logs.Warning.Printf("can't delete parts of failed table %v, %v", tableDirectory, deleteErr)
+		}
+	}
+	return err
+}
+
+// Wait for free worker slot on disk with directory, returned function releases slot
+func (fz *FreezePartitions) acquireDisk(directory string) func() {
+	if fz.PerDiskParallel < 1 {
+		return func() {}
+	}
+
+	// directories on unknown disk share one slot pool
+	deviceID, _ := fileutils.DeviceID(directory)
 
-			// replace ATTACH TABLE to CREATE TABLE in metadata files
-			err = fileutils.ReplaceStringInDirectoryFiles(
-				outDirectory+"/metadata/"+partition.DatabaseName,
-				"ATTACH",
-				"CREATE",
-			)
-			if err != nil {
-				logs.Error.Printf("can't replace string in metadata files, %v", err)
+	fz.disksMutex.Lock()
+	if fz.disks == nil {
+		fz.disks = make(map[uint64]chan struct{})
+	}
+	slots, ok := fz.disks[deviceID]
+	if !ok {
+		slots = make(chan struct{}, fz.PerDiskParallel)
+		fz.disks[deviceID] = slots
+	}
+	fz.disksMutex.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// Check metadata file is of inner table of materialized view, inner tables are created by views
+func IsInnerTableFile(fileName string) bool {
+	return strings.HasPrefix(fileName, "%2Einner%2E") || strings.HasPrefix(fileName, "%2Einner_id%2E")
+}
+
+// Copy metadata files selected by match function, ATTACH TABLE is replaced to CREATE TABLE in them
+func CopyMetadata(ctx context.Context, sourceDirectory string, destination storage.Storage, name string, match func(fileName string) bool) error {
+	fileDescriptors, err := ioutil.ReadDir(sourceDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, fileDescriptor := range fileDescriptors {
+		if fileDescriptor.IsDir() || IsInnerTableFile(fileDescriptor.Name()) || (match != nil && !match(fileDescriptor.Name())) {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		fileContent, err := ioutil.ReadFile(sourceDirectory + "/" + fileDescriptor.Name())
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(fileDescriptor.Name(), ".sql") {
+			fileContent = []byte(strings.Replace(string(fileContent), "ATTACH", "CREATE", -1))
+		}
+		err = storage.PutBytes(destination, name+"/"+fileDescriptor.Name(), fileContent)
+		if err != nil {
+			return fmt.Errorf("can't copy %v, %v", fileDescriptor.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// Copy parts of table, parts unchanged since previous backup are hardlinked from it
+func CopyTableParts(ctx context.Context, sourceDirectory string, destination storage.Storage, name string, previousDirectory string) error {
+	partsFD, err := ioutil.ReadDir(sourceDirectory)
+	if err != nil {
+		return err
+	}
+
+	linker, canLink := destination.(storage.Linker)
+
+	for _, partDescriptor := range partsFD {
+		if !partDescriptor.IsDir() {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		sourcePart := sourceDirectory + "/" + partDescriptor.Name()
+		destinationPart := name + "/" + partDescriptor.Name()
+
+		if previousDirectory != "" && canLink {
+			previousPart := previousDirectory + "/" + partDescriptor.Name()
+			isEqual, err := fileutils.IsFilesEqual(
+				sourcePart+"/"+ChecksumsFileName,
+				previousPart+"/"+ChecksumsFileName)
+			if err == nil && isEqual {
+				logs.Info.Printf("link unchanged part from %v to %v", previousPart, destinationPart)
+				err = linker.LinkDirectory(previousPart, destinationPart)
+				if err == nil {
+					continue
+				}
+				if err != storage.ErrNotSupported {
+					return err
+				}
 			}
 		}
+
+		logs.Info.Printf("copy part from %v to %v", sourcePart, destinationPart)
+		if err = storage.PutDirectory(ctx, destination, sourcePart, destinationPart, nil); err != nil {
+			return fmt.Errorf("can't copy part %v, %v", partDescriptor.Name(), err)
+		}
 	}
 
 	return nil
+}
+
+// Check table is included and not excluded by filter patterns
+func (tf TableFilter) Match(databaseName string, tableName string) bool {
+	name := databaseName + "." + tableName
+
+	included := len(tf.Include) == 0
+	for _, pattern := range tf.Include {
+		if matched, _ := path.Match(pattern, name); matched {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
 
+	for _, pattern := range tf.Exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Check table of metadata file is matched by filter
+func (tf TableFilter) MatchFile(databaseName string, fileName string) bool {
+	return tf.Match(databaseName, TableOfFile(fileName))
+}
+
+// Get table name of metadata file, file names are escaped by clickhouse
+func TableOfFile(fileName string) string {
+	tableName := strings.TrimSuffix(fileName, ".sql")
+	if unescaped, err := url.PathUnescape(tableName); err == nil {
+		tableName = unescaped
+	}
+	return tableName
+}
+
+// Name used in queries without quotes
+var plainName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Get name of database or table for query, names with other symbols than letters, digits and underscore are quoted
+func QuoteName(name string) string {
+	if plainName.MatchString(name) {
+		return name
+	}
+	return "`" + strings.Replace(strings.Replace(name, "\\", "\\\\", -1), "`", "\\`", -1) + "`"
 }
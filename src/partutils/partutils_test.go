@@ -0,0 +1,356 @@
+package partutils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	logs "logging"
+	"os"
+	"sort"
+	"storage"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTableFilter(t *testing.T) {
+	tests := []struct {
+		filter   TableFilter
+		database string
+		table    string
+		expected bool
+	}{
+		{TableFilter{}, "analytics", "events", true},
+		{TableFilter{Include: []string{"analytics.events_*"}}, "analytics", "events_2020", true},
+		{TableFilter{Include: []string{"analytics.events_*"}}, "analytics", "users", false},
+		{TableFilter{Include: []string{"analytics.events_*"}}, "other", "events_2020", false},
+		{TableFilter{Exclude: []string{"*.tmp_*"}}, "analytics", "tmp_load", false},
+		{TableFilter{Exclude: []string{"*.tmp_*"}}, "analytics", "events", true},
+		{TableFilter{Include: []string{"analytics.*", "logs.*"}, Exclude: []string{"analytics.tmp_*"}}, "logs", "access", true},
+		{TableFilter{Include: []string{"analytics.*", "logs.*"}, Exclude: []string{"analytics.tmp_*"}}, "analytics", "tmp_load", false},
+	}
+
+	for _, test := range tests {
+		if matched := test.filter.Match(test.database, test.table); matched != test.expected {
+			t.Errorf("%+v %v.%v: got %v, expected %v", test.filter, test.database, test.table, matched, test.expected)
+		}
+	}
+
+	filter := TableFilter{Include: []string{"analytics.events.v2"}}
+	if !filter.MatchFile("analytics", "events%2Ev2.sql") {
+		t.Errorf("got events%%2Ev2.sql not matched by %+v", filter)
+	}
+}
+
+func TestPartitionFilter(t *testing.T) {
+	tests := []struct {
+		filter   PartitionFilter
+		id       string
+		expected bool
+	}{
+		{PartitionFilter{}, "202001", true},
+		{PartitionFilter{IDs: []string{"202001", "202003"}}, "202003", true},
+		{PartitionFilter{IDs: []string{"202001", "202003"}}, "202002", false},
+		{PartitionFilter{IDs: []string{"2020*"}}, "202011", true},
+		{PartitionFilter{From: "202002", To: "202004"}, "202001", false},
+		{PartitionFilter{From: "202002", To: "202004"}, "202004", true},
+		{PartitionFilter{From: "202002"}, "202105", true},
+	}
+
+	for _, test := range tests {
+		if matched := test.filter.Match(test.id); matched != test.expected {
+			t.Errorf("%+v %v: got %v, expected %v", test.filter, test.id, matched, test.expected)
+		}
+	}
+	if PartitionOfPart("202001_1_5_1_7") != "202001" {
+		t.Errorf("got partition %v of 202001_1_5_1_7", PartitionOfPart("202001_1_5_1_7"))
+	}
+}
+
+func TestQuoteName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"events":    "events",
+		"events.v2": "`events.v2`",
+		"my-db":     "`my-db`",
+		"2020":      "`2020`",
+		"a`b":       "`a\\`b`",
+	} {
+		if quoted := QuoteName(name); quoted != expected {
+			t.Errorf("%v: got %v, expected %v", name, quoted, expected)
+		}
+	}
+}
+
+func TestAcquireDisk(t *testing.T) {
+	directory, err := ioutil.TempDir("", "partutils_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	for _, test := range []struct {
+		perDiskParallel int
+		expected        int
+	}{
+		{0, 4},
+		{2, 2},
+		{1, 1},
+	} {
+		var (
+			wait    sync.WaitGroup
+			mutex   sync.Mutex
+			running int
+			maximum int
+		)
+		fz := FreezePartitions{PerDiskParallel: test.perDiskParallel}
+		for i := 0; i < 4; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				release := fz.acquireDisk(directory)
+				defer release()
+
+				mutex.Lock()
+				running++
+				if running > maximum {
+					maximum = running
+				}
+				mutex.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+			}()
+		}
+		wait.Wait()
+		if maximum != test.expected {
+			t.Errorf("per disk %v: got %v running jobs, expected %v", test.perDiskParallel, maximum, test.expected)
+		}
+	}
+}
+
+func TestFreezeQueries(t *testing.T) {
+	job := &tableJob{databaseName: "my-db", tableName: "events", partitions: []PartitionDescribe{
+		{DatabaseName: "my-db", TableName: "events", PartID: "202001"},
+		{DatabaseName: "my-db", TableName: "events", PartID: "202002"},
+	}}
+
+	for _, test := range []struct {
+		mode     string
+		expected []string
+	}{
+		{FreezeModeTable, []string{"ALTER TABLE `my-db`.events FREEZE WITH NAME 'clickhousedump_test';"}},
+		{FreezeModePartition, []string{
+			"ALTER TABLE `my-db`.events FREEZE PARTITION ID '202001' WITH NAME 'clickhousedump_test';",
+			"ALTER TABLE `my-db`.events FREEZE PARTITION ID '202002' WITH NAME 'clickhousedump_test';",
+		}},
+	} {
+		fz := FreezePartitions{Mode: test.mode, ShadowName: "clickhousedump_test"}
+		if queries := fz.freezeQueries(job); strings.Join(queries, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%v: got %v, expected %v", test.mode, queries, test.expected)
+		}
+	}
+}
+
+// Create temporary directory with parts of tables in root directory
+func testParts(t *testing.T, root string, tables map[string][]string) string {
+	directory, err := ioutil.TempDir("", "partutils_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for table, partNames := range tables {
+		for _, partName := range partNames {
+			partDirectory := directory + "/" + root + "/" + table + "/" + partName
+			if err = os.MkdirAll(partDirectory, os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(partDirectory+"/"+ChecksumsFileName, []byte(partName), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return directory
+}
+
+func TestCopyTables(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	sourceDirectory := testParts(t, "shadow/clickhousedump_test/data", map[string][]string{
+		"my%2Ddb/events%2Ev2": {"202001_1_1_0", "202002_2_2_0"},
+		"my%2Ddb/users":       {"all_1_1_0"},
+	})
+	defer os.RemoveAll(sourceDirectory)
+	destinationDirectory, err := ioutil.TempDir("", "partutils_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destinationDirectory)
+
+	fz := FreezePartitions{
+		ShadowName:      "clickhousedump_test",
+		SourceDirectory: sourceDirectory,
+		Destination:     &storage.Local{Directory: destinationDirectory},
+		Parallel:        2,
+		PerDiskParallel: 1,
+	}
+	jobs := groupByTables([]PartitionDescribe{
+		{DatabaseName: "my-db", TableName: "events.v2", PartID: "202001"},
+		{DatabaseName: "my-db", TableName: "users", PartID: "tuple()"},
+		{DatabaseName: "my-db", TableName: "events.v2", PartID: "202002"},
+	})
+	if len(jobs) != 2 || len(jobs[0].partitions) != 2 {
+		t.Fatalf("got %v jobs, expected 2 tables", len(jobs))
+	}
+	err = fz.runJobs(context.Background(), jobs, func(job *tableJob) error {
+		return fz.copyTable(context.Background(), job)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fz.Destination.List("partitions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"partitions/my%2Ddb/events%2Ev2/202001_1_1_0/checksums.txt",
+		"partitions/my%2Ddb/events%2Ev2/202002_2_2_0/checksums.txt",
+		"partitions/my%2Ddb/users/all_1_1_0/checksums.txt",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("got files %v, expected %v", names, expected)
+	}
+}
+
+func TestRunJobsPerDiskLimit(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	directory, err := ioutil.TempDir("", "partutils_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	var jobs []*tableJob
+	for i := 0; i < 8; i++ {
+		jobs = append(jobs, &tableJob{databaseName: "db", tableName: fmt.Sprint("table_", i)})
+	}
+
+	for _, test := range []struct {
+		parallel        int
+		perDiskParallel int
+		expected        int
+	}{
+		{4, 0, 4},
+		{4, 2, 2},
+		{1, 2, 1},
+	} {
+		var (
+			mutex   sync.Mutex
+			running int
+			maximum int
+		)
+		fz := FreezePartitions{Parallel: test.parallel, PerDiskParallel: test.perDiskParallel}
+		err = fz.runJobs(context.Background(), jobs, func(job *tableJob) error {
+			release := fz.acquireDisk(directory)
+			defer release()
+
+			mutex.Lock()
+			running++
+			if running > maximum {
+				maximum = running
+			}
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maximum != test.expected {
+			t.Errorf("parallel %v, per disk %v: got %v running jobs, expected %v", test.parallel, test.perDiskParallel, maximum, test.expected)
+		}
+	}
+}
+
+func TestRunJobsContinueOnError(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	jobs := []*tableJob{{databaseName: "db", tableName: "a"}, {databaseName: "db", tableName: "b"}, {databaseName: "db", tableName: "c"}}
+	work := func(job *tableJob) error {
+		if job.tableName == "b" {
+			return fmt.Errorf("broken")
+		}
+		return nil
+	}
+
+	fz := FreezePartitions{Parallel: 2, ContinueOnError: true}
+	if err := fz.runJobs(context.Background(), jobs, work); err != nil {
+		t.Fatal(err)
+	}
+	if !fz.Failed.Has("db.b") || fz.Failed.Has("db.a") || !jobs[1].failed {
+		t.Errorf("got failures %v, expected db.b", fz.Failed.List)
+	}
+
+	jobs = []*tableJob{{databaseName: "db", tableName: "a"}, {databaseName: "db", tableName: "b"}}
+	fz = FreezePartitions{Parallel: 2}
+	if err := fz.runJobs(context.Background(), jobs, work); err == nil || err.Error() != "db.b: broken" {
+		t.Errorf("got %v, expected db.b: broken", err)
+	}
+}
+
+func TestGetPartitionsListFromDir(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	sourceDirectory := testParts(t, "partitions", map[string][]string{
+		"my%2Ddb/events%2Ev2": {"202001_1_1_0", "202002_2_2_0", "202002_3_3_0", "202003_4_4_0"},
+	})
+	defer os.RemoveAll(sourceDirectory)
+	destinationDirectory, err := ioutil.TempDir("", "partutils_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destinationDirectory)
+
+	cmdGetPartitionsListFromDir := GetPartitionsListFromDir{
+		Source:               &storage.Local{Directory: sourceDirectory},
+		DestinationDirectory: destinationDirectory,
+		DatabaseName:         "my%2Ddb",
+		TableName:            "events%2Ev2",
+		Partitions:           PartitionFilter{From: "202002", To: "202002"},
+	}
+	if err = cmdGetPartitionsListFromDir.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var partNames []string
+	for _, part := range cmdGetPartitionsListFromDir.Result {
+		partNames = append(partNames, part.PartID)
+	}
+	if strings.Join(partNames, ",") != "202002_2_2_0,202002_3_3_0" {
+		t.Errorf("got parts %v, expected 202002_2_2_0,202002_3_3_0", partNames)
+	}
+	detached, err := ioutil.ReadDir(destinationDirectory + "/data/my%2Ddb/events%2Ev2/detached")
+	if err != nil || len(detached) != 2 {
+		t.Errorf("got %v detached parts (%v), expected 2", len(detached), err)
+	}
+
+	// parts existing in table are not copied
+	cmdGetPartitionsListFromDir.DryRunFlag = true
+	cmdGetPartitionsListFromDir.SkipParts = map[string]bool{"202002_2_2_0": true}
+	if err = cmdGetPartitionsListFromDir.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmdGetPartitionsListFromDir.Result) != 1 || cmdGetPartitionsListFromDir.Result[0].PartID != "202002_3_3_0" {
+		t.Errorf("got parts %v, expected 202002_3_3_0", cmdGetPartitionsListFromDir.Result)
+	}
+}
@@ -0,0 +1,186 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	logs "logging"
+	"manifest"
+	"path"
+	"storage"
+	"time"
+)
+
+// Retention policy, zero values keep nothing by the rule
+type Policy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+}
+
+type PruneBackups struct {
+	Destination storage.Storage
+	Policy      Policy
+	Now         time.Time
+	Result      []string
+}
+
+// Delete backups and archives outside retention policy and incomplete backups, bases of kept incremental backups are kept.
+// Backup directories without manifest can be running backups and are not deleted
+func (pb *PruneBackups) Run(ctx context.Context) error {
+
+	backups, err := manifest.ListBackups(pb.Destination)
+	if err != nil {
+		return err
+	}
+
+	keep := pb.keptBackups(backups)
+	for _, backup := range backups {
+		if reason, ok := keep[backup.Name]; ok {
+			logs.Info.Printf("keep %v (%v)", backup.Name, reason)
+			continue
+		}
+		if !backup.Archive && backup.Manifest == nil {
+			logs.Info.Printf("keep %v (no %v)", backup.Name, manifest.FileName)
+			continue
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		logs.Info.Printf("delete %v created at %v", backup.Name, backup.StartTime())
+		if err = deleteBackup(pb.Destination, backup); err != nil {
+			return err
+		}
+		pb.Result = append(pb.Result, backup.Name)
+	}
+
+	return nil
+}
+
+// Get reasons to keep backups by name, incomplete backups are not kept by policy
+// and bases of kept incremental backups are kept
+func (pb *PruneBackups) keptBackups(backups []manifest.Backup) map[string]string {
+	var completeBackups []manifest.Backup
+	for _, backup := range backups {
+		if backup.Archive || backup.Manifest != nil && backup.Manifest.Incomplete == "" {
+			completeBackups = append(completeBackups, backup)
+		}
+	}
+
+	keep := make(map[string]string)
+	pb.keepLast(completeBackups, keep)
+	pb.keepPeriodic(completeBackups, keep, "daily", pb.Now.AddDate(0, 0, -pb.Policy.KeepDaily), func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	pb.keepPeriodic(completeBackups, keep, "weekly", pb.Now.AddDate(0, 0, -7*pb.Policy.KeepWeekly), func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%v-W%v", year, week)
+	})
+	pb.keepPeriodic(completeBackups, keep, "monthly", pb.Now.AddDate(0, -pb.Policy.KeepMonthly, 0), func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+	keepBases(backups, keep)
+	return keep
+}
+
+// Keep N latest backups, backups are sorted by start time
+func (pb *PruneBackups) keepLast(backups []manifest.Backup, keep map[string]string) {
+	for i := len(backups) - 1; i >= 0 && i >= len(backups)-pb.Policy.KeepLast; i-- {
+		keep[backups[i].Name] = "last"
+	}
+}
+
+// Keep latest backup of every period (day, week or month) started after time
+func (pb *PruneBackups) keepPeriodic(backups []manifest.Backup, keep map[string]string, rule string, after time.Time, period func(time.Time) string) {
+	if !after.Before(pb.Now) {
+		return
+	}
+
+	periods := make(map[string]bool)
+	for i := len(backups) - 1; i >= 0; i-- {
+		startTime := backups[i].StartTime()
+		if startTime.Before(after) || periods[period(startTime)] {
+			continue
+		}
+		periods[period(startTime)] = true
+		if _, ok := keep[backups[i].Name]; !ok {
+			keep[backups[i].Name] = rule
+		}
+	}
+}
+
+// Keep bases of kept incremental backups
+func keepBases(backups []manifest.Backup, keep map[string]string) {
+	baseOf := make(map[string]string)
+	for _, backup := range backups {
+		if backup.Manifest != nil && backup.Manifest.IncrementalFrom != "" {
+			baseOf[backup.Name] = path.Base(backup.Manifest.IncrementalFrom)
+		}
+	}
+
+	for _, backup := range backups {
+		if _, ok := keep[backup.Name]; !ok {
+			continue
+		}
+		for name := baseOf[backup.Name]; name != ""; name = baseOf[name] {
+			if _, ok := keep[name]; ok {
+				break
+			}
+			keep[name] = "base of " + backup.Name
+		}
+	}
+}
+
+// Delete archive or backup directory, backup without manifest is incomplete, so manifest is deleted first
+func deleteBackup(destination storage.Storage, backup manifest.Backup) error {
+	if !backup.Archive {
+		if err := destination.Delete(path.Join(backup.Name, manifest.FileName)); err != nil {
+			return err
+		}
+	}
+	return destination.Delete(backup.Name)
+}
+
+type DeleteBackup struct {
+	Destination storage.Storage
+	Name        string
+	Force       bool
+}
+
+// Delete backup directory or archive, incremental bases and incomplete backups are deleted only with Force
+func (db *DeleteBackup) Run(ctx context.Context) error {
+
+	backups, err := manifest.ListBackups(db.Destination)
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	var found *manifest.Backup
+	for i, backup := range backups {
+		if backup.Name == db.Name {
+			found = &backups[i]
+		}
+		if backup.Manifest != nil && backup.Manifest.IncrementalFrom != "" && path.Base(backup.Manifest.IncrementalFrom) == db.Name && !db.Force {
+			return fmt.Errorf("%v is base of incremental backup %v", db.Name, backup.Name)
+		}
+	}
+
+	switch {
+	case found == nil:
+		return fmt.Errorf("%v not found", db.Name)
+	case found.Archive:
+		logs.Info.Printf("delete archive %v", db.Name)
+	case found.Manifest == nil && !db.Force:
+		return fmt.Errorf("%v has no %v, backup is incomplete or in progress", db.Name, manifest.FileName)
+	case found.Manifest == nil:
+		logs.Info.Printf("delete incomplete backup %v", db.Name)
+	default:
+		logs.Info.Printf("delete %v", db.Name)
+	}
+	return deleteBackup(db.Destination, *found)
+}
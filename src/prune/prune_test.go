@@ -0,0 +1,171 @@
+package prune
+
+import (
+	"context"
+	"io/ioutil"
+	logs "logging"
+	"manifest"
+	"os"
+	"path"
+	"sort"
+	"storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC)
+
+// Backups started every given hours before now, incremental backups are "name:base"
+func testBackups(names []string, hours int) []manifest.Backup {
+	var result []manifest.Backup
+	for i, name := range names {
+		backup := manifest.Backup{Manifest: &manifest.Manifest{
+			StartTime: testNow.Add(-time.Duration((len(names)-i)*hours) * time.Hour),
+		}}
+		nameAndBase := strings.Split(name, ":")
+		backup.Name = nameAndBase[0]
+		if len(nameAndBase) == 2 {
+			backup.Manifest.IncrementalFrom = "/backups/" + nameAndBase[1]
+		}
+		result = append(result, backup)
+	}
+	return result
+}
+
+func keptNames(keep map[string]string) string {
+	var names []string
+	for name, reason := range keep {
+		names = append(names, name+"="+reason)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestKeepPolicy(t *testing.T) {
+	// backup every 12 hours for 10 days
+	var names, allLast []string
+	for i := 0; i < 20; i++ {
+		names = append(names, string(rune('a'+i)))
+		allLast = append(allLast, names[i]+"=last")
+	}
+	backups := testBackups(names, 12)
+
+	tests := []struct {
+		policy Policy
+		kept   string
+	}{
+		{Policy{}, ""},
+		{Policy{KeepLast: 3}, "r=last,s=last,t=last"},
+		{Policy{KeepLast: 30}, strings.Join(allLast, ",")},
+		// latest backup of every day started in last 3 days, o is started exactly 3 days ago
+		{Policy{KeepDaily: 3}, "o=daily,q=daily,s=daily,t=daily"},
+		{Policy{KeepLast: 2, KeepDaily: 2}, "q=daily,s=last,t=last"},
+		// 2020-03-15 is Sunday, backups of weeks 11 and 10 are in range
+		{Policy{KeepWeekly: 1}, "g=weekly,t=weekly"},
+		{Policy{KeepMonthly: 1}, "t=monthly"},
+	}
+
+	for _, test := range tests {
+		pb := &PruneBackups{Policy: test.policy, Now: testNow}
+		keep := pb.keptBackups(backups)
+		if kept := keptNames(keep); kept != test.kept {
+			t.Errorf("%+v: kept %v, expected %v", test.policy, kept, test.kept)
+		}
+	}
+}
+
+func TestKeepBases(t *testing.T) {
+	backups := testBackups([]string{"full1", "inc1:full1", "inc2:inc1", "full2", "inc3:full2", "other:missing"}, 1)
+
+	tests := []struct {
+		keep map[string]string
+		kept string
+	}{
+		{map[string]string{}, ""},
+		{map[string]string{"full2": "last"}, "full2=last"},
+		{map[string]string{"inc2": "last"}, "full1=base of inc2,inc1=base of inc2,inc2=last"},
+		{map[string]string{"inc1": "daily", "inc2": "last"}, "full1=base of inc1,inc1=daily,inc2=last"},
+		{map[string]string{"inc3": "last", "other": "last"}, "full2=base of inc3,inc3=last,missing=base of other,other=last"},
+	}
+
+	for _, test := range tests {
+		keepBases(backups, test.keep)
+		if kept := keptNames(test.keep); kept != test.kept {
+			t.Errorf("kept %v, expected %v", kept, test.kept)
+		}
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	directory, err := ioutil.TempDir("", "prune_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	destination := &storage.Local{Directory: directory}
+
+	// backup directories with manifests, archives and running backup without manifest,
+	// running backup is listed last by modification time of its directory
+	for i, name := range []string{"old", "incomplete", "new"} {
+		backupManifest := manifest.New("test", "", "")
+		backupManifest.StartTime = testNow.Add(time.Duration(i-10) * time.Hour)
+		if name == "incomplete" {
+			backupManifest.Incomplete = "interrupted"
+		}
+		if err = storage.PutBytes(destination, path.Join(name, "metadata/db.sql"), []byte("CREATE DATABASE db")); err != nil {
+			t.Fatal(err)
+		}
+		if err = backupManifest.Write(&storage.Local{Directory: path.Join(directory, name)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, name := range []string{"old.tgz", "new.tgz"} {
+		if err = storage.PutBytes(destination, name, []byte("archive")); err != nil {
+			t.Fatal(err)
+		}
+		modTime := testNow.Add(time.Duration(i*15-20) * time.Hour)
+		if err = os.Chtimes(path.Join(directory, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = storage.PutBytes(destination, "running/metadata/db.sql", []byte("CREATE DATABASE db")); err != nil {
+		t.Fatal(err)
+	}
+	// other files in backups directory are not backups
+	for _, name := range []string{"plan.sql", "old.tgz.sha256", "upload.tar.gz.tmp"} {
+		if err = storage.PutBytes(destination, name, []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(path.Join(directory, name), testNow.Add(-30*time.Hour), testNow.Add(-30*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pb := &PruneBackups{Destination: destination, Policy: Policy{KeepLast: 2}, Now: testNow}
+	if err = pb.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := strings.Join(pb.Result, ","); deleted != "old.tgz,old,incomplete" {
+		t.Errorf("deleted %v", deleted)
+	}
+
+	backups, err := manifest.ListBackups(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+	if strings.Join(names, ",") != "new,new.tgz,running" {
+		t.Errorf("kept %v", names)
+	}
+	for _, name := range []string{"plan.sql", "old.tgz.sha256", "upload.tar.gz.tmp"} {
+		if _, err = destination.Stat(name); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+}
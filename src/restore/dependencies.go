@@ -0,0 +1,337 @@
+package restore
+
+import (
+	"fmt"
+	parts "partutils"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Name of database object in DDL: plain, `quoted` or "quoted"
+const namePattern = "(`[^`]+`|\"[^\"]+\"|\\w+)"
+
+var (
+	// tables and views in FROM, JOIN and TO clauses, table functions are skipped by trailing bracket
+	clauseReference = regexp.MustCompile("(?i)\\b(FROM|JOIN|TO)\\s+(?:" + namePattern + "\\.)?" + namePattern + "(\\s*\\()?")
+	// TO DISK and TO VOLUME of TTL clause
+	storageClause = regexp.MustCompile("(?i)^TO\\s+(?:DISK|VOLUME)\\s*'")
+	// subquery in brackets
+	subquery = regexp.MustCompile("(?i)^\\s*(?:SELECT|WITH)\\b")
+	// database and table arguments of Distributed, Buffer and Merge engines
+	distributedEngine = regexp.MustCompile("(?i)\\bDistributed\\s*\\(\\s*[^,]+,\\s*([^,]+?)\\s*,\\s*([^,)]+?)\\s*[,)]")
+	bufferEngine      = regexp.MustCompile("(?i)\\bBuffer\\s*\\(\\s*([^,]+?)\\s*,\\s*([^,]+?)\\s*,")
+	mergeEngine       = regexp.MustCompile("(?i)\\bENGINE\\s*=\\s*Merge\\s*\\(\\s*([^,]+?)\\s*,")
+	// dictionary of Dictionary engine and dictionary functions
+	dictionaryEngine   = regexp.MustCompile("(?i)\\bDictionary\\s*\\(\\s*([^)]+?)\\s*\\)")
+	dictionaryFunction = regexp.MustCompile("(?i)\\bdict(?:Get\\w*|Has|IsIn)\\s*\\(\\s*'([^']+)'")
+	// table of dictionary with CLICKHOUSE source
+	dictionarySource   = regexp.MustCompile("(?i)\\bSOURCE\\s*\\(\\s*CLICKHOUSE\\s*\\(([^)]*)\\)")
+	dictionaryTable    = regexp.MustCompile("(?i)\\bTABLE\\s+'([^']+)'")
+	dictionaryDatabase = regexp.MustCompile("(?i)\\bDB\\s+'([^']+)'")
+	// name of created object
+	createHeader = regexp.MustCompile("(?i)^\\s*CREATE\\s+(?:OR\\s+REPLACE\\s+)?(?:TABLE|(?:MATERIALIZED\\s+|LIVE\\s+)?VIEW|DICTIONARY)\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?(?:" + namePattern + "\\.)?" + namePattern)
+)
+
+// Reference to object of database in DDL query, positions of database are
+// positions of its unquoted name in query and are -1 for reference without database
+type objectReference struct {
+	database      string
+	name          string
+	databaseStart int
+	databaseEnd   int
+	// Merge engine references tables by regular expression
+	dependency bool
+}
+
+// Get positions of unquoted name or string argument
+func unquotePosition(query string, start int, end int) (int, int) {
+	if end-start >= 2 && strings.ContainsAny(query[start:start+1], "`\"'") && query[end-1] == query[start] {
+		return start + 1, end - 1
+	}
+	return start, end
+}
+
+// Remove quotes of name or string argument
+func unquoteName(name string) string {
+	start, end := unquotePosition(name, 0, len(name))
+	return name[start:end]
+}
+
+// Get ranges of string literals in query
+func stringLiterals(query string) [][2]int {
+	var (
+		result [][2]int
+		start  = -1
+	)
+	for i := 0; i < len(query); i++ {
+		switch {
+		case start < 0 && query[i] == '\'':
+			start = i
+		case start >= 0 && query[i] == '\\':
+			i++
+		case start >= 0 && query[i] == '\'':
+			if i+1 < len(query) && query[i+1] == '\'' {
+				i++
+				continue
+			}
+			result = append(result, [2]int{start, i + 1})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		result = append(result, [2]int{start, len(query)})
+	}
+	return result
+}
+
+// Check position is outside of brackets or in brackets of subquery
+func inSubquery(query string, position int, inLiteral func(int) bool) bool {
+	depth := 0
+	for i := position - 1; i >= 0; i-- {
+		if inLiteral(i) {
+			continue
+		}
+		switch query[i] {
+		case ')':
+			depth++
+		case '(':
+			if depth == 0 {
+				return subquery.MatchString(query[i+1:])
+			}
+			depth--
+		}
+	}
+	return true
+}
+
+// Find references to objects in identifier positions of DDL query, matches inside string literals are skipped
+func findReferences(query string) []objectReference {
+	var result []objectReference
+
+	literals := stringLiterals(query)
+	inLiteral := func(position int) bool {
+		for _, literal := range literals {
+			if position > literal[0] && position < literal[1] {
+				return true
+			}
+		}
+		return false
+	}
+	// database and name given by positions in query, database start is -1 without database
+	add := func(databaseStart, databaseEnd, nameStart, nameEnd int, dependency bool) {
+		reference := objectReference{databaseStart: -1, databaseEnd: -1, dependency: dependency}
+		if databaseStart >= 0 {
+			reference.databaseStart, reference.databaseEnd = unquotePosition(query, databaseStart, databaseEnd)
+			reference.database = query[reference.databaseStart:reference.databaseEnd]
+		}
+		if nameStart >= 0 {
+			nameStart, nameEnd = unquotePosition(query, nameStart, nameEnd)
+			reference.name = query[nameStart:nameEnd]
+		}
+		result = append(result, reference)
+	}
+	// qualified name in string argument
+	addQualified := func(start, end int) {
+		start, end = unquotePosition(query, start, end)
+		if dot := strings.Index(query[start:end], "."); dot >= 0 {
+			add(start, start+dot, start+dot+1, end, true)
+		} else {
+			add(-1, -1, start, end, true)
+		}
+	}
+
+	for _, match := range clauseReference.FindAllStringSubmatchIndex(query, -1) {
+		if inLiteral(match[0]) || match[8] >= 0 || storageClause.MatchString(query[match[0]:]) {
+			continue
+		}
+		// FROM in function arguments as in EXTRACT(DAY FROM d) is not a table
+		if strings.EqualFold(query[match[2]:match[3]], "FROM") && !inSubquery(query, match[0], inLiteral) {
+			continue
+		}
+		add(match[4], match[5], match[6], match[7], true)
+	}
+	for _, engine := range []*regexp.Regexp{distributedEngine, bufferEngine} {
+		for _, match := range engine.FindAllStringSubmatchIndex(query, -1) {
+			if !inLiteral(match[0]) {
+				add(match[2], match[3], match[4], match[5], true)
+			}
+		}
+	}
+	for _, match := range mergeEngine.FindAllStringSubmatchIndex(query, -1) {
+		if !inLiteral(match[0]) {
+			add(match[2], match[3], -1, -1, false)
+		}
+	}
+	for _, function := range []*regexp.Regexp{dictionaryEngine, dictionaryFunction} {
+		for _, match := range function.FindAllStringSubmatchIndex(query, -1) {
+			if !inLiteral(match[0]) {
+				addQualified(match[2], match[3])
+			}
+		}
+	}
+	for _, match := range dictionarySource.FindAllStringSubmatchIndex(query, -1) {
+		if inLiteral(match[0]) {
+			continue
+		}
+		source := query[match[2]:match[3]]
+		table := dictionaryTable.FindStringSubmatchIndex(source)
+		database := dictionaryDatabase.FindStringSubmatchIndex(source)
+		switch {
+		case table != nil && database != nil:
+			add(match[2]+database[2], match[2]+database[3], match[2]+table[2], match[2]+table[3], true)
+		case table != nil:
+			add(-1, -1, match[2]+table[2], match[2]+table[3], true)
+		case database != nil:
+			add(match[2]+database[2], match[2]+database[3], -1, -1, false)
+		}
+	}
+
+	return result
+}
+
+// Check database of reference is the database, references without database are in the same database
+func isSameDatabase(database string, databaseName string) bool {
+	return database == "" || database == databaseName || strings.HasPrefix(database, "currentDatabase")
+}
+
+// Get names of objects of database referenced by DDL query, objects without database are in the same database
+func objectReferences(databaseName string, query string) []string {
+	var result []string
+	for _, reference := range findReferences(query) {
+		if reference.dependency && reference.name != "" && isSameDatabase(reference.database, databaseName) {
+			result = append(result, reference.name)
+		}
+	}
+	return result
+}
+
+// Replace database in references to objects of database in DDL query, string literals and other databases are not changed
+func renameReferences(query string, oldName string, newName string) string {
+	references := findReferences(query)
+	// replace from end of query to keep positions of other references
+	sort.Slice(references, func(i, j int) bool {
+		return references[i].databaseStart > references[j].databaseStart
+	})
+
+	previousStart := len(query) + 1
+	for _, reference := range references {
+		if reference.databaseStart < 0 || reference.database != oldName || reference.databaseStart == previousStart {
+			continue
+		}
+		name := newName
+		if reference.databaseStart == 0 || !strings.ContainsAny(query[reference.databaseStart-1:reference.databaseStart], "`\"'") {
+			name = parts.QuoteName(newName)
+		}
+		query = query[:reference.databaseStart] + name + query[reference.databaseEnd:]
+		previousStart = reference.databaseStart
+	}
+	return query
+}
+
+// Qualify name of created object with database, database of qualified name is replaced
+func qualifyObjectName(query string, databaseName string) (string, error) {
+	match := createHeader.FindStringSubmatchIndex(query)
+	if match == nil {
+		return "", fmt.Errorf("can't find object name in query")
+	}
+	nameStart := match[4]
+	if match[2] >= 0 {
+		nameStart = match[2]
+	}
+	return query[:nameStart] + parts.QuoteName(databaseName) + "." + query[match[4]:], nil
+}
+
+// Object which is not created because of dependency cycle
+type cycleFailure struct {
+	object metadataFiles
+	err    error
+}
+
+// Order objects so that every object is created after objects it references, tables are created
+// before other objects without dependencies between them, objects in dependency cycles
+// and objects depending on them are returned as failures
+func sortObjects(databaseName string, objects []metadataFiles) ([]metadataFiles, []cycleFailure) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].objectType == "table" && objects[j].objectType != "table"
+	})
+
+	index := make(map[string]int)
+	for i, object := range objects {
+		index[parts.TableOfFile(object.fileName)] = i
+	}
+	dependencies := make([][]int, len(objects))
+	for i, object := range objects {
+		for _, name := range objectReferences(databaseName, object.metaData) {
+			if j, ok := index[name]; ok && j != i {
+				dependencies[i] = append(dependencies[i], j)
+			}
+		}
+	}
+
+	var (
+		ordered  []metadataFiles
+		failures []cycleFailure
+		created  = make([]bool, len(objects))
+	)
+	ready := func(i int) bool {
+		for _, j := range dependencies[i] {
+			if !created[j] {
+				return false
+			}
+		}
+		return true
+	}
+	for progress := true; progress; {
+		progress = false
+		for i, object := range objects {
+			if !created[i] && ready(i) {
+				created[i] = true
+				ordered = append(ordered, object)
+				progress = true
+			}
+		}
+	}
+
+	// objects of cycles are reported before objects depending on them
+	var dependent []cycleFailure
+	for i, object := range objects {
+		if created[i] {
+			continue
+		}
+		cycle, inCycle := findCycle(objects, dependencies, created, i)
+		if inCycle {
+			failures = append(failures, cycleFailure{object: object, err: fmt.Errorf("dependency cycle %v", cycle)})
+		} else {
+			dependent = append(dependent, cycleFailure{object: object, err: fmt.Errorf("depends on dependency cycle %v", cycle)})
+		}
+	}
+
+	return ordered, append(failures, dependent...)
+}
+
+// Follow dependencies of not created object until cycle is found, inCycle is true when object is part of cycle
+func findCycle(objects []metadataFiles, dependencies [][]int, created []bool, start int) (cycle string, inCycle bool) {
+	var path []int
+	position := make(map[int]int)
+
+	for current := start; ; {
+		if first, visited := position[current]; visited {
+			var names []string
+			for _, i := range append(path[first:], current) {
+				names = append(names, objects[i].objectName)
+			}
+			return strings.Join(names, " -> "), first == 0
+		}
+		position[current] = len(path)
+		path = append(path, current)
+
+		// object is not created only when some dependency is not created
+		for _, next := range dependencies[current] {
+			if !created[next] {
+				current = next
+				break
+			}
+		}
+	}
+}
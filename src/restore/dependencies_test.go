@@ -0,0 +1,191 @@
+package restore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestObjectReferences(t *testing.T) {
+	tests := []struct {
+		query      string
+		references string
+	}{
+		{"CREATE TABLE prod.events (d Date) ENGINE = MergeTree(d, d, 8192)", ""},
+		{"CREATE VIEW prod.v AS SELECT * FROM prod.events", "events"},
+		{"CREATE VIEW prod.v AS SELECT * FROM events AS e JOIN `users` USING id", "events,users"},
+		{"CREATE VIEW prod.v AS SELECT * FROM other.events", ""},
+		{"CREATE VIEW prod.v AS SELECT * FROM numbers(10)", ""},
+		{"CREATE VIEW prod.v AS SELECT 'FROM fake' AS s FROM prod.events", "events"},
+		{"CREATE MATERIALIZED VIEW prod.mv TO prod.target AS SELECT * FROM prod.events", "target,events"},
+		{"CREATE TABLE prod.d (id UInt64) ENGINE = Distributed(cluster, prod, events_local, rand())", "events_local"},
+		{"CREATE TABLE prod.d (id UInt64) ENGINE = Distributed(cluster, currentDatabase(), events_local)", "events_local"},
+		{"CREATE TABLE prod.b (id UInt64) ENGINE = Buffer(prod, events, 16, 10, 100, 10000, 1000000, 10000000, 100000000)", "events"},
+		{"CREATE TABLE prod.m (id UInt64) ENGINE = Merge(prod, '^events')", ""},
+		{"CREATE TABLE prod.t (id UInt64) ENGINE = Dictionary(prod.dict)", "dict"},
+		{"CREATE VIEW prod.v AS SELECT dictGetString('prod.dict', 'name', id) FROM prod.events", "events,dict"},
+		{"CREATE DICTIONARY prod.dict (id UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(HOST 'localhost' DB 'prod' TABLE 'names')) LAYOUT(FLAT())", "names"},
+		{"CREATE DICTIONARY prod.dict (id UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(DB 'other' TABLE 'names')) LAYOUT(FLAT())", ""},
+		{"CREATE VIEW prod.v AS SELECT EXTRACT(DAY FROM d) AS day, substring(s FROM 2) FROM prod.events", "events"},
+		{"CREATE VIEW prod.v AS SELECT * FROM prod.events WHERE id IN (SELECT id FROM prod.users)", "events,users"},
+		{"CREATE TABLE prod.t (d Date) ENGINE = MergeTree ORDER BY d TTL d + INTERVAL 1 DAY TO DISK 'cold', d + INTERVAL 1 WEEK TO VOLUME 'archive'", ""},
+		{"CREATE MATERIALIZED VIEW prod.mv TO prod.disk AS SELECT * FROM prod.events", "disk,events"},
+	}
+
+	for _, test := range tests {
+		references := strings.Join(objectReferences("prod", test.query), ",")
+		if references != test.references {
+			t.Errorf("%v: got references %v, expected %v", test.query, references, test.references)
+		}
+	}
+}
+
+func TestRenameReferences(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			"CREATE VIEW prod.v AS SELECT * FROM prod.events JOIN `prod`.users USING id WHERE s = 'prod.events'",
+			"CREATE VIEW prod.v AS SELECT * FROM copy.events JOIN `copy`.users USING id WHERE s = 'prod.events'",
+		},
+		{
+			"CREATE MATERIALIZED VIEW prod.mv TO prod.target AS SELECT * FROM other.events",
+			"CREATE MATERIALIZED VIEW prod.mv TO copy.target AS SELECT * FROM other.events",
+		},
+		{
+			"CREATE TABLE prod.d (id UInt64) ENGINE = Distributed(cluster, 'prod', events_local, rand())",
+			"CREATE TABLE prod.d (id UInt64) ENGINE = Distributed(cluster, 'copy', events_local, rand())",
+		},
+		{
+			"CREATE TABLE prod.m (id UInt64) ENGINE = Merge(prod, '^prod')",
+			"CREATE TABLE prod.m (id UInt64) ENGINE = Merge(copy, '^prod')",
+		},
+		{
+			"CREATE VIEW prod.v AS SELECT dictGet('prod.dict', 'name', id) AS name FROM production.events",
+			"CREATE VIEW prod.v AS SELECT dictGet('copy.dict', 'name', id) AS name FROM production.events",
+		},
+		{
+			"CREATE DICTIONARY prod.dict (id UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(DB 'prod' TABLE 'names' WHERE 'prod')) LAYOUT(FLAT())",
+			"CREATE DICTIONARY prod.dict (id UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(DB 'copy' TABLE 'names' WHERE 'prod')) LAYOUT(FLAT())",
+		},
+	}
+
+	for _, test := range tests {
+		if query := renameReferences(test.query, "prod", "copy"); query != test.expected {
+			t.Errorf("got %v, expected %v", query, test.expected)
+		}
+	}
+
+	query := renameReferences("CREATE VIEW prod.v AS SELECT * FROM prod.events JOIN `prod`.users USING id", "prod", "prod-copy")
+	if expected := "CREATE VIEW prod.v AS SELECT * FROM `prod-copy`.events JOIN `prod-copy`.users USING id"; query != expected {
+		t.Errorf("got %v, expected %v", query, expected)
+	}
+}
+
+func TestQualifyObjectName(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"CREATE TABLE events (d Date)", "CREATE TABLE copy.events (d Date)"},
+		{"CREATE TABLE prod.events (d Date)", "CREATE TABLE copy.events (d Date)"},
+		{"CREATE TABLE IF NOT EXISTS `prod`.`events` (d Date)", "CREATE TABLE IF NOT EXISTS copy.`events` (d Date)"},
+		{"CREATE MATERIALIZED VIEW prod.mv TO prod.target AS SELECT 1", "CREATE MATERIALIZED VIEW copy.mv TO prod.target AS SELECT 1"},
+		{"CREATE DICTIONARY dict (id UInt64)", "CREATE DICTIONARY copy.dict (id UInt64)"},
+	}
+
+	for _, test := range tests {
+		query, err := qualifyObjectName(test.query, "copy")
+		if err != nil || query != test.expected {
+			t.Errorf("got %v (%v), expected %v", query, err, test.expected)
+		}
+	}
+	if _, err := qualifyObjectName("ATTACH something", "copy"); err == nil {
+		t.Error("query without object name is accepted")
+	}
+	if query, _ := qualifyObjectName("CREATE TABLE events (d Date)", "my-db"); query != "CREATE TABLE `my-db`.events (d Date)" {
+		t.Errorf("database name is not quoted: %v", query)
+	}
+}
+
+func TestSortObjects(t *testing.T) {
+	object := func(name, objectType, query string) metadataFiles {
+		return metadataFiles{name + ".sql", name, objectType, query}
+	}
+
+	tests := []struct {
+		name     string
+		objects  []metadataFiles
+		ordered  string
+		failures []string
+	}{
+		{
+			"tables first without dependencies",
+			[]metadataFiles{
+				object("v", "other", "CREATE VIEW prod.v AS SELECT 1"),
+				object("a", "table", "CREATE TABLE prod.a (id UInt64) ENGINE = Log"),
+				object("b", "table", "CREATE TABLE prod.b (id UInt64) ENGINE = Log"),
+			},
+			"a,b,v",
+			nil,
+		},
+		{
+			"table depends on view and dictionary",
+			[]metadataFiles{
+				object("d", "table", "CREATE TABLE prod.d (id UInt64) ENGINE = Distributed(cluster, prod, local)"),
+				object("t", "table", "CREATE TABLE prod.t (id UInt64) ENGINE = Dictionary(dict)"),
+				object("dict", "other", "CREATE DICTIONARY prod.dict (id UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(TABLE 'names')) LAYOUT(FLAT())"),
+				object("names", "table", "CREATE TABLE prod.names (id UInt64) ENGINE = Log"),
+				object("local", "other", "CREATE VIEW prod.local AS SELECT * FROM prod.names"),
+			},
+			"names,dict,local,d,t",
+			nil,
+		},
+		{
+			"materialized view after target and source",
+			[]metadataFiles{
+				object("mv", "view", "CREATE MATERIALIZED VIEW prod.mv TO prod.target AS SELECT * FROM prod.v"),
+				object("v", "other", "CREATE VIEW prod.v AS SELECT * FROM prod.events"),
+				object("events", "table", "CREATE TABLE prod.events (id UInt64) ENGINE = Log"),
+				object("target", "table", "CREATE TABLE prod.target (id UInt64) ENGINE = Log"),
+			},
+			"events,target,v,mv",
+			nil,
+		},
+		{
+			"dependency cycle",
+			[]metadataFiles{
+				object("t", "table", "CREATE TABLE prod.t (id UInt64) ENGINE = Log"),
+				object("c", "other", "CREATE VIEW prod.c AS SELECT * FROM prod.a"),
+				object("a", "other", "CREATE VIEW prod.a AS SELECT * FROM prod.b"),
+				object("b", "other", "CREATE VIEW prod.b AS SELECT * FROM prod.a JOIN prod.t USING id"),
+			},
+			"t",
+			[]string{
+				"a: dependency cycle a -> b -> a",
+				"b: dependency cycle b -> a -> b",
+				"c: depends on dependency cycle a -> b -> a",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		ordered, failures := sortObjects("prod", test.objects)
+
+		var names []string
+		for _, object := range ordered {
+			names = append(names, object.objectName)
+		}
+		if strings.Join(names, ",") != test.ordered {
+			t.Errorf("%v: got order %v, expected %v", test.name, strings.Join(names, ","), test.ordered)
+		}
+
+		var failed []string
+		for _, failure := range failures {
+			failed = append(failed, failure.object.objectName+": "+failure.err.Error())
+		}
+		if strings.Join(failed, "; ") != strings.Join(test.failures, "; ") {
+			t.Errorf("%v: got failures %v, expected %v", test.name, failed, test.failures)
+		}
+	}
+}
@@ -1,48 +1,281 @@
 package restore
 
 import (
+	"archive/tar"
+	"context"
 	"fileutils"
 	"fmt"
+	"io"
 	"io/ioutil"
 	logs "logging"
+	"manifest"
 	"os"
 	parts "partutils"
+	"regexp"
+	"storage"
 	"strings"
+	"tarball"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 type RestoreDatabase struct {
 	DatabaseName         string
-	SourceDirectory      string
+	TargetDatabaseName   string
+	Source               storage.Storage
 	DestinationDirectory string
+	MoveFlag             bool
+	Filter               parts.TableFilter
+	ContinueOnError      bool
+	Manifest             *manifest.Manifest
+	Conflict             string
+	Plan                 Plan
+	Failed               parts.Failures
+	renameSuffix         string
 }
 
-// Restore database
-func (rb *RestoreDatabase) Run(databaseConnection *sqlx.DB) error {
+// Ordered statements and part copies of restore, in dry run statements are only recorded
+type Plan struct {
+	DryRunFlag bool
+	// dry run reads existing tables of conflict policy from server
+	CheckExistingFlag bool
+	Statements        []string
+}
+
+// Execute statement or record it in dry run
+func (pl *Plan) exec(ctx context.Context, databaseConnection *sqlx.DB, query string) error {
+	if pl.DryRunFlag {
+		pl.Statements = append(pl.Statements, strings.TrimSuffix(strings.TrimSpace(query), ";")+";")
+		return nil
+	}
+	_, err := databaseConnection.ExecContext(ctx, query)
+	return err
+}
+
+// Record file operation of dry run as SQL comment
+func (pl *Plan) comment(format string, args ...interface{}) {
+	if pl.DryRunFlag {
+		pl.Statements = append(pl.Statements, "-- "+fmt.Sprintf(format, args...))
+	}
+}
+
+// Write recorded statements as SQL script
+func (pl *Plan) Write(writer io.Writer) error {
+	for _, statement := range pl.Statements {
+		if _, err := fmt.Fprintf(writer, "%v\n", statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Conflict policies for objects already existing in restored database,
+// restore into existing database is allowed only with conflict policy
+const (
+	ConflictFail            = "fail"
+	ConflictSkip            = "skip"
+	ConflictDropAndRecreate = "drop-and-recreate"
+	ConflictAttachPartsOnly = "attach-parts-only"
+	ConflictRenameExisting  = "rename-existing"
+)
+
+var ConflictPolicies = []string{
+	ConflictFail,
+	ConflictSkip,
+	ConflictDropAndRecreate,
+	ConflictAttachPartsOnly,
+	ConflictRenameExisting,
+}
+
+// Check conflict policy name is known
+func IsConflictPolicy(name string) bool {
+	for _, policy := range ConflictPolicies {
+		if name == policy {
+			return true
+		}
+	}
+	return false
+}
 
-	type metadataFiles struct {
-		fileName,
-		objectName,
-		objectType,
-		metaData string
+// Get parts of table recorded in backup manifest, known is false for backups without manifest
+func (rb *RestoreDatabase) manifestParts(tableName string) (partNames []string, known bool) {
+	if rb.Manifest == nil {
+		return nil, false
 	}
+	for _, database := range rb.Manifest.Databases {
+		if database.Name != rb.DatabaseName {
+			continue
+		}
+		for _, table := range database.Tables {
+			if table.Name != tableName {
+				continue
+			}
+			for _, part := range table.Parts {
+				partNames = append(partNames, part.Name)
+			}
+		}
+	}
+	return partNames, true
+}
+
+// Get parts which have no files in listed directory
+func missingParts(partNames []string, files []storage.FileInfo, directory string) []string {
+	var result []string
+
+	listed := make(map[string]bool)
+	for _, file := range files {
+		listed[strings.Split(strings.TrimPrefix(file.Name, directory), "/")[0]] = true
+	}
+	for _, partName := range partNames {
+		if !listed[partName] {
+			result = append(result, partName)
+		}
+	}
+	return result
+}
+
+// Get name of restored database, backup database is restored under own name by default
+func (rb *RestoreDatabase) targetDatabase() string {
+	if rb.TargetDatabaseName == "" {
+		return rb.DatabaseName
+	}
+	return rb.TargetDatabaseName
+}
+
+// ZooKeeper path of replicated table
+var replicatedEngine = regexp.MustCompile("(?i)\\bENGINE\\s*=\\s*Replicated\\w*MergeTree\\s*\\(\\s*'([^']*)'")
+
+// Replace database name in ZooKeeper path of replicated table, table with path without database name
+// or macros can't be restored under new name because it would be replica of backup database table
+func renameReplicaPath(query string, oldName string, newName string) (string, error) {
+	match := replicatedEngine.FindStringSubmatchIndex(query)
+	if match == nil {
+		return query, nil
+	}
+	replicaPath := query[match[2]:match[3]]
+	if strings.Contains(replicaPath, "{database}") || strings.Contains(replicaPath, "{uuid}") {
+		return query, nil
+	}
+
+	renamed := false
+	segments := strings.Split(replicaPath, "/")
+	for i := range segments {
+		if segments[i] == oldName {
+			segments[i] = newName
+			renamed = true
+		}
+	}
+	if !renamed {
+		return "", fmt.Errorf("ZooKeeper path %v of replicated table has no database name, table can't be restored as %v", replicaPath, newName)
+	}
+	return query[:match[2]] + strings.Join(segments, "/") + query[match[3]:], nil
+}
+
+// Get query creating object in restored database, references to backup database and
+// ZooKeeper paths of replicated tables are renamed for restore under new name
+func (rb *RestoreDatabase) createQuery(metaData string) (string, error) {
 	var (
-		err             error
-		fileDescriptors []os.FileInfo
-		metaFiles       []metadataFiles
+		err            error
+		query          = metaData
+		targetDatabase = rb.targetDatabase()
 	)
+	if targetDatabase != rb.DatabaseName {
+		query = renameReferences(query, rb.DatabaseName, targetDatabase)
+		if query, err = renameReplicaPath(query, rb.DatabaseName, targetDatabase); err != nil {
+			return "", err
+		}
+	}
+	return qualifyObjectName(query, targetDatabase)
+}
 
-	logs.Info.Printf("try to create database %v", rb.DatabaseName)
-	_, err = databaseConnection.Exec(fmt.Sprintf("CREATE DATABASE %v", rb.DatabaseName))
-	if err != nil {
-		logs.Error.Printf("failed to create database %v", rb.DatabaseName)
-		return err
-	} else {
-		logs.Info.Println("success")
+// Get object kind for DROP and RENAME queries
+func objectKind(metaData string) string {
+	if strings.HasPrefix(metaData, "CREATE DICTIONARY") {
+		return "DICTIONARY"
+	}
+	return "TABLE"
+}
+
+// Apply conflict policy to object existing in restored database, create is false when object is kept
+// and restore is false when object and its parts are skipped
+func (rb *RestoreDatabase) resolveConflict(ctx context.Context, databaseConnection *sqlx.DB, tableName string, metaData string) (create bool, restore bool, err error) {
+	object := rb.targetDatabase() + "." + tableName
+	// queries use unescaped names of database and table
+	database := parts.QuoteName(rb.targetDatabase()) + "."
+
+	switch rb.Conflict {
+	case ConflictSkip:
+		logs.Info.Printf("%v already exists, skip", object)
+		return false, false, nil
+	case ConflictAttachPartsOnly:
+		logs.Info.Printf("%v already exists, attach parts only", object)
+		return false, true, nil
+	case ConflictDropAndRecreate:
+		query := fmt.Sprintf("DROP %v %v", objectKind(metaData), database+parts.QuoteName(tableName))
+		logs.Info.Println(query)
+		if err = rb.Plan.exec(ctx, databaseConnection, query); err != nil {
+			return false, false, fmt.Errorf("can't drop existing object, %v", err)
+		}
+		return true, true, nil
+	case ConflictRenameExisting:
+		query := fmt.Sprintf("RENAME %v %v TO %v", objectKind(metaData), database+parts.QuoteName(tableName), database+parts.QuoteName(tableName+rb.renameSuffix))
+		logs.Info.Println(query)
+		if err = rb.Plan.exec(ctx, databaseConnection, query); err != nil {
+			return false, false, fmt.Errorf("can't rename existing object, %v", err)
+		}
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("already exists")
 	}
+}
+
+// Get names of active parts of existing table in restored database
+func (rb *RestoreDatabase) existingParts(ctx context.Context, databaseConnection *sqlx.DB, tableName string) (map[string]bool, error) {
+	cmdGetParts := parts.GetParts{
+		Database: rb.targetDatabase(),
+		Table:    tableName,
+	}
+	if err := cmdGetParts.Run(ctx, databaseConnection); err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool)
+	for _, partName := range cmdGetParts.Result {
+		result[partName] = true
+	}
+	return result, nil
+}
+
+// Record failure of object with continue on error policy or return error with object context
+func (rb *RestoreDatabase) fail(ctx context.Context, object string, err error) error {
+	if rb.ContinueOnError && ctx.Err() == nil {
+		rb.Failed.Add(object, err)
+		return nil
+	}
+	return fmt.Errorf("%v: %v", object, err)
+}
+
+type metadataFiles struct {
+	fileName,
+	objectName,
+	objectType,
+	metaData string
+}
 
-	if fileDescriptors, err = ioutil.ReadDir(rb.SourceDirectory + "/metadata/" + rb.DatabaseName); err != nil {
+// Restore database
+func (rb *RestoreDatabase) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
+
+	var (
+		err       error
+		files     []storage.FileInfo
+		metaFiles []metadataFiles
+	)
+
+	// backup directories of database and tables have escaped names
+	targetDatabase := rb.targetDatabase()
+	databaseDirectory := fileutils.EscapeForFileName(rb.DatabaseName)
+	metadataDirectory := "metadata/" + databaseDirectory + "/"
+	if files, err = rb.Source.List(metadataDirectory); err != nil {
 		return err
 	}
 	if err != nil {
@@ -51,34 +284,44 @@ func (rb *RestoreDatabase) Run(databaseConnection *sqlx.DB) error {
 		logs.Info.Println("success")
 	}
 
-	for _, fileDescriptor := range fileDescriptors {
-		if !fileDescriptor.IsDir() && (strings.HasSuffix(fileDescriptor.Name(), ".sql") || !strings.HasSuffix(fileDescriptor.Name(), "%2E")) {
+	for _, file := range files {
+		fileName := strings.TrimPrefix(file.Name, metadataDirectory)
+		if !strings.Contains(fileName, "/") && (strings.HasSuffix(fileName, ".sql") || !strings.HasSuffix(fileName, "%2E")) {
+			// inner tables of materialized views are created by views, some backups contain their metadata
+			if parts.IsInnerTableFile(fileName) {
+				logs.Info.Printf("skip metadata file %v of materialized view inner table", fileName)
+				continue
+			}
+			if !rb.Filter.MatchFile(rb.DatabaseName, fileName) {
+				logs.Info.Printf("skip metadata file %v by filter", fileName)
+				continue
+			}
 
-			logs.Info.Printf("try to read from metadata file %v", fileDescriptor.Name())
-			fileContent, err := ioutil.ReadFile(rb.SourceDirectory + "/metadata/" + rb.DatabaseName + "/" + fileDescriptor.Name())
+			logs.Info.Printf("try to read from metadata file %v", fileName)
+			fileContent, err := storage.GetBytes(rb.Source, file.Name)
 			if err != nil {
-				logs.Info.Printf("cant't read from metadata file %v", fileDescriptor.Name())
+				logs.Info.Printf("cant't read from metadata file %v", fileName)
 				return err
 			} else {
 				logs.Info.Println("success")
 				if strings.HasPrefix(string(fileContent[:]), "CREATE TABLE") { // if object is TABLE
 					metaFiles = append(metaFiles, metadataFiles{
-						fileDescriptor.Name(),
-						strings.Replace(fileDescriptor.Name(), ".sql", "", -1),
+						fileName,
+						strings.Replace(fileName, ".sql", "", -1),
 						"table",
 						string(fileContent[:]),
 					})
 				} else if strings.HasPrefix(string(fileContent[:]), "CREATE MATERIALIZED VIEW") { // if object is view
 					metaFiles = append(metaFiles, metadataFiles{
-						fileDescriptor.Name(),
-						strings.Replace(fileDescriptor.Name(), ".sql", "", -1),
+						fileName,
+						strings.Replace(fileName, ".sql", "", -1),
 						"view",
 						string(fileContent[:]),
 					})
 				} else { // is other type object
 					metaFiles = append(metaFiles, metadataFiles{
-						fileDescriptor.Name(),
-						strings.Replace(fileDescriptor.Name(), ".sql", "", -1),
+						fileName,
+						strings.Replace(fileName, ".sql", "", -1),
 						"other",
 						string(fileContent[:]),
 					})
@@ -88,74 +331,177 @@ func (rb *RestoreDatabase) Run(databaseConnection *sqlx.DB) error {
 		}
 	}
 
-	// create only tables first
+	// objects are created after objects they reference, objects in dependency cycles are not created
+	metaFiles, cycles := sortObjects(rb.DatabaseName, metaFiles)
+	for _, cycle := range cycles {
+		logs.Error.Printf("can't order %v, %v", cycle.object.objectName, cycle.err)
+		if err = rb.fail(ctx, targetDatabase+"."+cycle.object.objectName, cycle.err); err != nil {
+			return err
+		}
+	}
+
+	createDatabase := "CREATE DATABASE %v"
+	if rb.Conflict != "" {
+		createDatabase = "CREATE DATABASE IF NOT EXISTS %v"
+	}
+	logs.Info.Printf("try to create database %v", targetDatabase)
+	err = rb.Plan.exec(ctx, databaseConnection, fmt.Sprintf(createDatabase, parts.QuoteName(targetDatabase)))
+	if err != nil {
+		logs.Error.Printf("failed to create database %v", targetDatabase)
+		return err
+	} else {
+		logs.Info.Println("success")
+	}
+
+	// objects of existing database are resolved by conflict policy, dry run does not query server
+	// unless it is allowed to read list of tables
+	existingObjects := make(map[string]bool)
+	if rb.Conflict != "" && rb.Plan.DryRunFlag && !rb.Plan.CheckExistingFlag {
+		rb.Plan.comment("existing tables are not checked in dry run, they are resolved by %v conflict policy", rb.Conflict)
+	} else if rb.Conflict != "" {
+		cmdGetTables := parts.GetTables{
+			Database: targetDatabase,
+		}
+		if err = cmdGetTables.Run(ctx, databaseConnection); err != nil {
+			logs.Error.Printf("can't get tables of database %v", targetDatabase)
+			return err
+		}
+		for _, table := range cmdGetTables.Result {
+			existingObjects[table.TableName] = true
+		}
+		rb.renameSuffix = "_before_restore_" + time.Now().UTC().Format("20060102T150405")
+	}
+
 	for _, metadataFile := range metaFiles {
 		if metadataFile.objectType == "table" {
-			logs.Info.Printf("try to apply metadata from file %v", metadataFile.fileName)
-			_, err = databaseConnection.Exec(
-				strings.Replace(
-					metadataFile.metaData,
-					"CREATE TABLE ",
-					"CREATE TABLE "+rb.DatabaseName+".", -1))
-			if err != nil {
-				logs.Info.Printf("cant't apply metadata file %v", metadataFile.fileName)
-				return err
-			} else {
-				logs.Info.Println("success")
+			create, restore := true, true
+			if existingObjects[parts.TableOfFile(metadataFile.fileName)] {
+				create, restore, err = rb.resolveConflict(ctx, databaseConnection, parts.TableOfFile(metadataFile.fileName), metadataFile.metaData)
+				if err != nil {
+					if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, err); err != nil {
+						return err
+					}
+					continue
+				}
+				if !restore {
+					continue
+				}
 			}
 
-			hasPartitions, err := fileutils.IsExists(rb.SourceDirectory + "/partitions/" + rb.DatabaseName + "/" + metadataFile.objectName)
+			if create {
+				logs.Info.Printf("try to apply metadata from file %v", metadataFile.fileName)
+				query, err := rb.createQuery(metadataFile.metaData)
+				if err == nil {
+					err = rb.Plan.exec(ctx, databaseConnection, query)
+				}
+				if err != nil {
+					logs.Info.Printf("cant't apply metadata file %v", metadataFile.fileName)
+					if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, fmt.Errorf("can't create table, %v", err)); err != nil {
+						return err
+					}
+					continue
+				} else {
+					logs.Info.Println("success")
+				}
+			}
+
+			// parts of kept table are not attached again, parts merged or mutated in table after backup
+			// have other names and their data is attached twice
+			var existingParts map[string]bool
+			if !create {
+				if existingParts, err = rb.existingParts(ctx, databaseConnection, parts.TableOfFile(metadataFile.fileName)); err != nil {
+					if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, fmt.Errorf("can't get parts of existing table, %v", err)); err != nil {
+						return err
+					}
+					continue
+				}
+				logs.Warning.Printf("attach parts of backup missing in existing table %v.%v, data of parts merged after backup is duplicated",
+					targetDatabase, parts.TableOfFile(metadataFile.fileName))
+			}
+
+			partitionsDirectory := "partitions/" + databaseDirectory + "/" + metadataFile.objectName + "/"
+			partitionFiles, err := rb.Source.List(partitionsDirectory)
 			if err != nil {
+				if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, fmt.Errorf("can't list parts, %v", err)); err != nil {
+					return err
+				}
+				continue
+			}
+			// parts of manifest must be in backup, backups without manifest are not checked
+			manifestParts, known := rb.manifestParts(parts.TableOfFile(metadataFile.fileName))
+			if missing := missingParts(manifestParts, partitionFiles, partitionsDirectory); len(missing) > 0 {
+				if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, fmt.Errorf("parts %v are missing in backup", strings.Join(missing, ", "))); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(partitionFiles) == 0 && !known && strings.Contains(metadataFile.metaData, "MergeTree") {
 				logs.Error.Printf("not found partitions for %v", metadataFile.objectName)
+			} else if len(partitionFiles) == 0 {
+				logs.Info.Printf("%v has no partitions in backup, only schema is restored", metadataFile.objectName)
 			}
 
-			if hasPartitions {
-				logs.Info.Printf("try to attach partitions for %v", rb.DatabaseName+"."+metadataFile.objectName)
+			if len(partitionFiles) > 0 {
+				logs.Info.Printf("try to attach partitions for %v", targetDatabase+"."+metadataFile.objectName)
 				cmdGetPartitionsListFromDir := parts.GetPartitionsListFromDir{
-					SourceDirectory:      rb.SourceDirectory,
+					Source:               rb.Source,
 					DestinationDirectory: rb.DestinationDirectory,
-					DatabaseName:         rb.DatabaseName,
+					DatabaseName:         databaseDirectory,
+					TargetDatabaseName:   fileutils.EscapeForFileName(targetDatabase),
 					TableName:            metadataFile.objectName,
+					MoveFlag:             rb.MoveFlag,
+					DryRunFlag:           rb.Plan.DryRunFlag,
+					SkipParts:            existingParts,
 				}
-				err = cmdGetPartitionsListFromDir.Run()
+				err = cmdGetPartitionsListFromDir.Run(ctx)
 				if err != nil {
 					logs.Error.Printf("can't get partition list for attach, %v", err)
+					if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, fmt.Errorf("can't copy parts, %v", err)); err != nil {
+						return err
+					}
+					continue
+				}
+				rb.Plan.copies(databaseDirectory, rb.DestinationDirectory, cmdGetPartitionsListFromDir.Result)
+
+				// parts are copied to escaped directories and attached by table name
+				var attachedParts []parts.PartitionDescribe
+				for _, part := range cmdGetPartitionsListFromDir.Result {
+					attachedParts = append(attachedParts, parts.PartitionDescribe{
+						DatabaseName: targetDatabase,
+						TableName:    parts.TableOfFile(metadataFile.fileName),
+						PartID:       part.PartID,
+					})
 				}
-				partitionsList := cmdGetPartitionsListFromDir.Result
-				for _, attachedPart := range partitionsList {
-					// attach partition
-					queryAttach := fmt.Sprintf(
-						"ALTER TABLE %v.%v ATTACH PART '%v';",
-						attachedPart.DatabaseName,
-						attachedPart.TableName,
-						attachedPart.PartID)
-					logs.Info.Println(queryAttach)
-					_, err = databaseConnection.Exec(queryAttach)
-					if err != nil {
-						logs.Info.Printf("can't attach partition %v to %v table in %v database, %v",
-							attachedPart.PartID,
-							attachedPart.TableName,
-							attachedPart.DatabaseName, err)
+				if err = rb.Plan.attachParts(ctx, databaseConnection, attachedParts); err != nil {
+					if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, err); err != nil {
 						return err
-					} else {
-						logs.Info.Println("success")
 					}
 				}
 			}
-		}
-	}
-	// create another objects
-	for _, metadataFile := range metaFiles {
-		if metadataFile.objectType != "table" {
+		} else {
+			if existingObjects[parts.TableOfFile(metadataFile.fileName)] {
+				create, _, err := rb.resolveConflict(ctx, databaseConnection, parts.TableOfFile(metadataFile.fileName), metadataFile.metaData)
+				if err != nil {
+					if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, err); err != nil {
+						return err
+					}
+					continue
+				}
+				if !create {
+					continue
+				}
+			}
+
 			logs.Info.Printf("try to apply metadata from file %v", metadataFile.fileName)
-			_, err = databaseConnection.Exec(
-				strings.Replace(
-					metadataFile.metaData,
-					metadataFile.objectName,
-					rb.DatabaseName+"."+metadataFile.objectName, -1))
+			query, err := rb.createQuery(metadataFile.metaData)
+			if err == nil {
+				err = rb.Plan.exec(ctx, databaseConnection, query)
+			}
 			if err != nil {
 				logs.Info.Printf("cant't apply metadata file %v", metadataFile.fileName)
-				return err
+				if err = rb.fail(ctx, targetDatabase+"."+metadataFile.objectName, fmt.Errorf("can't create object, %v", err)); err != nil {
+					return err
+				}
 			} else {
 				logs.Info.Println("success")
 			}
@@ -165,3 +511,162 @@ func (rb *RestoreDatabase) Run(databaseConnection *sqlx.DB) error {
 	return nil
 
 }
+
+// Record copies of backup parts to detached directories in dry run
+func (pl *Plan) copies(databaseName string, destinationDirectory string, partitionsList []parts.PartitionDescribe) {
+	for _, part := range partitionsList {
+		pl.comment("copy partitions/%v/%v/%v to %v/data/%v/%v/detached/%v",
+			databaseName, part.TableName, part.PartID,
+			destinationDirectory, part.DatabaseName, part.TableName, part.PartID)
+	}
+}
+
+// Attach parts copied to detached directories, stops on first failed part
+func (pl *Plan) attachParts(ctx context.Context, databaseConnection *sqlx.DB, partitionsList []parts.PartitionDescribe) error {
+	for _, attachedPart := range partitionsList {
+		// attach partition
+		queryAttach := fmt.Sprintf(
+			"ALTER TABLE %v.%v ATTACH PART '%v';",
+			parts.QuoteName(attachedPart.DatabaseName),
+			parts.QuoteName(attachedPart.TableName),
+			attachedPart.PartID)
+		logs.Info.Println(queryAttach)
+		err := pl.exec(ctx, databaseConnection, queryAttach)
+		if err != nil {
+			logs.Info.Printf("can't attach partition %v to %v table in %v database, %v",
+				attachedPart.PartID,
+				attachedPart.TableName,
+				attachedPart.DatabaseName, err)
+			return fmt.Errorf("can't attach part %v, %v", attachedPart.PartID, err)
+		} else {
+			logs.Info.Println("success")
+		}
+	}
+	return nil
+}
+
+type RestorePartitions struct {
+	DatabaseName         string
+	TargetDatabaseName   string
+	TableName            string
+	Source               storage.Storage
+	DestinationDirectory string
+	MoveFlag             bool
+	Partitions           parts.PartitionFilter
+	Plan                 Plan
+	Result               []parts.PartitionDescribe
+}
+
+// Copy parts of selected partitions to detached directory of existing table and attach them, table schema is not changed
+func (rp *RestorePartitions) Run(ctx context.Context, databaseConnection *sqlx.DB) error {
+	targetDatabase := rp.TargetDatabaseName
+	if targetDatabase == "" {
+		targetDatabase = rp.DatabaseName
+	}
+
+	// dry run does not query server
+	cmdGetTables := parts.GetTables{
+		Database: targetDatabase,
+	}
+	if !rp.Plan.DryRunFlag {
+		if err := cmdGetTables.Run(ctx, databaseConnection); err != nil {
+			return err
+		}
+	}
+	tableExists := rp.Plan.DryRunFlag
+	for _, table := range cmdGetTables.Result {
+		tableExists = tableExists || table.TableName == rp.TableName
+	}
+	if !tableExists {
+		return fmt.Errorf("table %v.%v not found, partitions are restored only into existing table", targetDatabase, rp.TableName)
+	}
+
+	logs.Info.Printf("try to restore partitions of %v.%v", targetDatabase, rp.TableName)
+	cmdGetPartitionsListFromDir := parts.GetPartitionsListFromDir{
+		Source:               rp.Source,
+		DestinationDirectory: rp.DestinationDirectory,
+		DatabaseName:         fileutils.EscapeForFileName(rp.DatabaseName),
+		TargetDatabaseName:   fileutils.EscapeForFileName(targetDatabase),
+		TableName:            fileutils.EscapeForFileName(rp.TableName),
+		MoveFlag:             rp.MoveFlag,
+		DryRunFlag:           rp.Plan.DryRunFlag,
+		Partitions:           rp.Partitions,
+	}
+	if err := cmdGetPartitionsListFromDir.Run(ctx); err != nil {
+		return fmt.Errorf("can't copy parts, %v", err)
+	}
+	if len(cmdGetPartitionsListFromDir.Result) == 0 {
+		return fmt.Errorf("no parts of selected partitions in backup of %v.%v", rp.DatabaseName, rp.TableName)
+	}
+
+	rp.Plan.copies(cmdGetPartitionsListFromDir.DatabaseName, rp.DestinationDirectory, cmdGetPartitionsListFromDir.Result)
+
+	// parts are copied to escaped directories and attached by table name
+	for _, part := range cmdGetPartitionsListFromDir.Result {
+		rp.Result = append(rp.Result, parts.PartitionDescribe{
+			DatabaseName: targetDatabase,
+			TableName:    rp.TableName,
+			PartID:       part.PartID,
+		})
+	}
+
+	return rp.Plan.attachParts(ctx, databaseConnection, rp.Result)
+}
+
+type ExtractArchive struct {
+	Source             io.Reader
+	DatabaseName       string
+	TemporaryDirectory string
+	MetadataOnlyFlag   bool
+	Directory          string
+	Result             storage.Storage
+}
+
+// Extract database metadata and partitions from backup archive to temporary directory, with metadata only
+// flag metadata is read in memory and part files are only listed from archive headers
+func (ea *ExtractArchive) Run(ctx context.Context) error {
+	var err error
+
+	databaseDirectory := fileutils.EscapeForFileName(ea.DatabaseName)
+	filter := databaseFilesFilter(databaseDirectory)
+	if ea.MetadataOnlyFlag {
+		logs.Info.Printf("read metadata of database %v from archive", ea.DatabaseName)
+		metadata := &storage.Memory{}
+		listing := &storage.Listing{Storage: metadata}
+		err = tarball.Read(storage.ContextReader(ctx, ea.Source), filter, func(header *tar.Header, content io.Reader) error {
+			if strings.HasPrefix(header.Name, "partitions/"+databaseDirectory+"/") {
+				listing.Files = append(listing.Files, storage.FileInfo{Name: header.Name, Size: header.Size})
+				return nil
+			}
+			return storage.PutReader(metadata, header.Name, header.Size, content)
+		})
+		if err != nil {
+			return err
+		}
+		ea.Result = listing
+		return nil
+	}
+
+	if ea.Directory, err = ioutil.TempDir(ea.TemporaryDirectory, "clickhousedump_restore_"); err != nil {
+		return err
+	}
+	logs.Info.Printf("extract database %v from archive to %v", ea.DatabaseName, ea.Directory)
+	err = tarball.Extract(storage.ContextReader(ctx, ea.Source), ea.Directory, filter)
+	if err != nil {
+		os.RemoveAll(ea.Directory)
+		return err
+	}
+
+	ea.Result = &storage.Local{Directory: ea.Directory}
+	return nil
+}
+
+// Select backup files needed for database restore by escaped database directory name
+func databaseFilesFilter(databaseDirectory string) func(name string) bool {
+	return func(name string) bool {
+		return name == manifest.FileName ||
+			name == manifest.DatabasesFileName ||
+			strings.HasPrefix(name, "metadata/"+databaseDirectory+"/") ||
+			strings.HasPrefix(name, "partitions/"+databaseDirectory+"/")
+	}
+}
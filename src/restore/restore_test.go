@@ -0,0 +1,230 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	logs "logging"
+	parts "partutils"
+	"storage"
+	"strings"
+	"tarball"
+	"testing"
+)
+
+// Files of backup with my-db.events.v2 table and view of it
+var testBackupFiles = map[string]string{
+	"metadata/my%2Ddb/events%2Ev2.sql":                 "CREATE TABLE `my-db`.`events.v2` (d Date) ENGINE = MergeTree ORDER BY d",
+	"metadata/my%2Ddb/daily.sql":                       "CREATE VIEW `my-db`.daily AS SELECT d FROM `my-db`.`events.v2`",
+	"partitions/my%2Ddb/events%2Ev2/1_1_1_0/data.bin":  "data",
+	"partitions/my%2Ddb/events%2Ev2/1_1_1_0/count.txt": "1",
+	"partitions/other/events/1_1_1_0/data.bin":         "data",
+}
+
+func TestMissingParts(t *testing.T) {
+	directory := "partitions/db/events/"
+	files := []storage.FileInfo{
+		{Name: directory + "202001_1_1_0/checksums.txt"},
+		{Name: directory + "202001_1_1_0/data.bin"},
+		{Name: directory + "202003_3_3_0/checksums.txt"},
+	}
+
+	missing := missingParts([]string{"202001_1_1_0", "202002_2_2_0", "202003_3_3_0"}, files, directory)
+	if fmt.Sprint(missing) != "[202002_2_2_0]" {
+		t.Errorf("got missing parts %v, expected [202002_2_2_0]", missing)
+	}
+}
+
+func TestRenameReplicaPath(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"CREATE TABLE prod.events (d Date) ENGINE = MergeTree ORDER BY d", "CREATE TABLE prod.events (d Date) ENGINE = MergeTree ORDER BY d"},
+		{
+			"CREATE TABLE prod.events (d Date) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/prod/events', '{replica}') ORDER BY d",
+			"CREATE TABLE prod.events (d Date) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/copy/events', '{replica}') ORDER BY d",
+		},
+		{
+			"CREATE TABLE prod.events (d Date) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{database}/events', '{replica}') ORDER BY d",
+			"CREATE TABLE prod.events (d Date) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{database}/events', '{replica}') ORDER BY d",
+		},
+	}
+
+	for _, test := range tests {
+		query, err := renameReplicaPath(test.query, "prod", "copy")
+		if err != nil || query != test.expected {
+			t.Errorf("got %v (%v), expected %v", query, err, test.expected)
+		}
+	}
+
+	query := "CREATE TABLE prod.events (d Date) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/events', '{replica}') ORDER BY d"
+	if _, err := renameReplicaPath(query, "prod", "copy"); err == nil {
+		t.Error("table with ZooKeeper path without database name is renamed")
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	tests := []struct {
+		conflict  string
+		tableName string
+		metaData  string
+		create    bool
+		restore   bool
+		plan      string
+	}{
+		{ConflictSkip, "events", "CREATE TABLE events", false, false, ""},
+		{ConflictAttachPartsOnly, "events", "CREATE TABLE events", false, true, ""},
+		{ConflictDropAndRecreate, "events", "CREATE TABLE events", true, true, "DROP TABLE `my-db`.events;"},
+		{ConflictDropAndRecreate, "events.v2", "CREATE TABLE `events.v2`", true, true, "DROP TABLE `my-db`.`events.v2`;"},
+		{ConflictDropAndRecreate, "names", "CREATE DICTIONARY names", true, true, "DROP DICTIONARY `my-db`.names;"},
+		{ConflictRenameExisting, "events.v2", "CREATE TABLE `events.v2`", true, true, "RENAME TABLE `my-db`.`events.v2` TO `my-db`.`events.v2_old`;"},
+	}
+
+	for _, test := range tests {
+		rb := RestoreDatabase{
+			DatabaseName: "my-db",
+			Conflict:     test.conflict,
+			Plan:         Plan{DryRunFlag: true},
+			renameSuffix: "_old",
+		}
+		create, restore, err := rb.resolveConflict(context.Background(), nil, test.tableName, test.metaData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := strings.Join(rb.Plan.Statements, "\n")
+		if create != test.create || restore != test.restore || plan != test.plan {
+			t.Errorf("%v %v: got %v, %v, %q, expected %v, %v, %q", test.conflict, test.tableName, create, restore, plan, test.create, test.restore, test.plan)
+		}
+	}
+
+	rb := RestoreDatabase{DatabaseName: "my-db", Conflict: ConflictFail, Plan: Plan{DryRunFlag: true}}
+	if _, _, err := rb.resolveConflict(context.Background(), nil, "events", "CREATE TABLE events"); err == nil {
+		t.Errorf("got no error for %v policy", ConflictFail)
+	}
+}
+
+func TestExtractArchiveMetadataOnly(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	var archive bytes.Buffer
+	archiveWriter, err := tarball.NewWriter(&archive, tarball.CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range testBackupFiles {
+		if err = storage.PutBytes(&storage.Archive{Writer: archiveWriter}, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = archiveWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmdExtractArchive := ExtractArchive{Source: &archive, DatabaseName: "my-db", MetadataOnlyFlag: true}
+	if err = cmdExtractArchive.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cmdExtractArchive.Directory != "" {
+		t.Errorf("got temporary directory %v, expected metadata in memory", cmdExtractArchive.Directory)
+	}
+
+	content, err := storage.GetBytes(cmdExtractArchive.Result, "metadata/my%2Ddb/daily.sql")
+	if err != nil || string(content) != testBackupFiles["metadata/my%2Ddb/daily.sql"] {
+		t.Errorf("got metadata %q (%v), expected %q", content, err, testBackupFiles["metadata/my%2Ddb/daily.sql"])
+	}
+	files, err := cmdExtractArchive.Result.List("partitions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if len(names) != 2 || !strings.HasPrefix(names[0], "partitions/my%2Ddb/events%2Ev2/1_1_1_0/") {
+		t.Errorf("got listed parts files %v, expected 2 files of my-db", names)
+	}
+}
+
+func TestRestoreDryRun(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	source := &storage.Memory{}
+	for name, content := range testBackupFiles {
+		if err := storage.PutBytes(source, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmdRestoreDatabase := RestoreDatabase{
+		DatabaseName:         "my-db",
+		TargetDatabaseName:   "my-copy",
+		Source:               source,
+		DestinationDirectory: "/var/lib/clickhouse",
+		Plan:                 Plan{DryRunFlag: true},
+	}
+	if err := cmdRestoreDatabase.Run(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var plan bytes.Buffer
+	if err := cmdRestoreDatabase.Plan.Write(&plan); err != nil {
+		t.Fatal(err)
+	}
+	expected := "CREATE DATABASE `my-copy`;\n" +
+		"CREATE TABLE `my-copy`.`events.v2` (d Date) ENGINE = MergeTree ORDER BY d;\n" +
+		"-- copy partitions/my%2Ddb/events%2Ev2/1_1_1_0 to /var/lib/clickhouse/data/my%2Dcopy/events%2Ev2/detached/1_1_1_0\n" +
+		"ALTER TABLE `my-copy`.`events.v2` ATTACH PART '1_1_1_0';\n" +
+		"CREATE VIEW `my-copy`.daily AS SELECT d FROM `my-copy`.`events.v2`;\n"
+	if plan.String() != expected {
+		t.Errorf("got plan\n%v\nexpected\n%v", plan.String(), expected)
+	}
+
+	// conflict policy is planned without connection to server
+	cmdRestoreDatabase.Conflict = ConflictSkip
+	cmdRestoreDatabase.Plan = Plan{DryRunFlag: true}
+	if err := cmdRestoreDatabase.Run(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	expected = "CREATE DATABASE IF NOT EXISTS `my-copy`;\n" +
+		"-- existing tables are not checked in dry run, they are resolved by skip conflict policy"
+	if plan := strings.Join(cmdRestoreDatabase.Plan.Statements, "\n"); !strings.HasPrefix(plan, expected+"\n") {
+		t.Errorf("got plan\n%v\nexpected\n%v", plan, expected)
+	}
+}
+
+func TestRestorePartitionsDryRun(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	source := &storage.Memory{}
+	for name, content := range testBackupFiles {
+		if err := storage.PutBytes(source, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmdRestorePartitions := RestorePartitions{
+		DatabaseName:         "my-db",
+		TableName:            "events.v2",
+		Source:               source,
+		DestinationDirectory: "/var/lib/clickhouse",
+		Partitions:           parts.PartitionFilter{IDs: []string{"1"}},
+		Plan:                 Plan{DryRunFlag: true},
+	}
+	if err := cmdRestorePartitions.Run(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := "-- copy partitions/my%2Ddb/events%2Ev2/1_1_1_0 to /var/lib/clickhouse/data/my%2Ddb/events%2Ev2/detached/1_1_1_0\n" +
+		"ALTER TABLE `my-db`.`events.v2` ATTACH PART '1_1_1_0';"
+	if plan := strings.Join(cmdRestorePartitions.Plan.Statements, "\n"); plan != expected {
+		t.Errorf("got plan\n%v\nexpected\n%v", plan, expected)
+	}
+
+	cmdRestorePartitions.Partitions = parts.PartitionFilter{IDs: []string{"2"}}
+	if err := cmdRestorePartitions.Run(context.Background(), nil); err == nil {
+		t.Errorf("got no error for partition without parts in backup")
+	}
+}
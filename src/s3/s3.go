@@ -0,0 +1,480 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal size of multipart upload part allowed by S3
+const MinPartSize = 5 * 1024 * 1024
+
+type Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	PartSize  int64
+}
+
+type Client struct {
+	config     Config
+	endpoint   *url.URL
+	httpClient *http.Client
+}
+
+type Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3 error %v %v: %v", e.StatusCode, e.Code, e.Message)
+}
+
+// Check error is "object not found"
+func IsNotFound(err error) bool {
+	s3Error, ok := err.(*Error)
+	return ok && (s3Error.StatusCode == http.StatusNotFound || s3Error.Code == "NoSuchKey")
+}
+
+// Create S3 client, http client can be replaced for tests
+func New(config Config, httpClient *http.Client) (*Client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if config.PartSize < MinPartSize {
+		config.PartSize = MinPartSize
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		config:     config,
+		endpoint:   endpoint,
+		httpClient: httpClient,
+	}, nil
+}
+
+// Make url of object in bucket
+func (c *Client) objectURL(key string, query url.Values) *url.URL {
+	result := *c.endpoint
+	if c.config.PathStyle {
+		result.Path = "/" + c.config.Bucket + "/" + key
+	} else {
+		result.Host = c.config.Bucket + "." + c.endpoint.Host
+		result.Path = "/" + key
+	}
+	result.RawPath = escapePath(result.Path)
+	result.RawQuery = query.Encode()
+	return &result
+}
+
+// Send signed request, error is returned for not 2xx responses
+func (c *Client) do(method string, key string, query url.Values, body io.Reader, contentLength int64) (*http.Response, error) {
+	request, err := http.NewRequest(method, c.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = contentLength
+		// empty body of unknown type is sent as chunked
+		if contentLength == 0 {
+			request.Body = http.NoBody
+		}
+	}
+	c.sign(request, time.Now().UTC())
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		s3Error := &Error{StatusCode: response.StatusCode}
+		content, _ := ioutil.ReadAll(response.Body)
+		xml.Unmarshal(content, s3Error)
+		return nil, s3Error
+	}
+
+	return response, nil
+}
+
+// Sign request with AWS signature version 4, payload is not signed
+func (c *Client) sign(request *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + c.config.Region + "/s3/aws4_request"
+
+	request.Header.Set("Host", request.URL.Host)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	var headerNames []string
+	for name := range request.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(request.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		escapePath(request.URL.Path),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.config.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, c.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 "+
+		"Credential="+c.config.AccessKey+"/"+scope+", "+
+		"SignedHeaders="+signedHeaders+", "+
+		"Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write([]byte(data))
+	return hash.Sum(nil)
+}
+
+// Escape string by RFC 3986 as S3 expects
+func escape(value string, keepSlash bool) string {
+	var result strings.Builder
+	for _, symbol := range []byte(value) {
+		if (symbol >= 'a' && symbol <= 'z') ||
+			(symbol >= 'A' && symbol <= 'Z') ||
+			(symbol >= '0' && symbol <= '9') ||
+			symbol == '-' || symbol == '_' || symbol == '.' || symbol == '~' ||
+			(keepSlash && symbol == '/') {
+			result.WriteByte(symbol)
+		} else {
+			result.WriteString(fmt.Sprintf("%%%02X", symbol))
+		}
+	}
+	return result.String()
+}
+
+func escapePath(value string) string {
+	return escape(value, true)
+}
+
+func canonicalQuery(query url.Values) string {
+	var result []string
+	for key, values := range query {
+		for _, value := range values {
+			result = append(result, escape(key, false)+"="+escape(value, false))
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, "&")
+}
+
+// Upload object, large objects are uploaded by parts. Object of known size smaller
+// than part is streamed with one request, size is -1 when it is unknown
+func (c *Client) PutObject(key string, body io.Reader, size int64) error {
+	if size >= 0 && size < c.config.PartSize {
+		response, err := c.do("PUT", key, nil, body, size)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+
+	part, err := readPart(body, nil, c.config.PartSize)
+	if err != nil {
+		return err
+	}
+
+	// object is smaller than one part
+	if int64(len(part)) < c.config.PartSize {
+		response, err := c.do("PUT", key, nil, bytes.NewReader(part), int64(len(part)))
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+
+	uploadID, err := c.createMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+
+	var completedParts []completedPart
+	for partNumber := 1; len(part) > 0; partNumber++ {
+		etag, err := c.uploadPart(key, uploadID, partNumber, part)
+		if err != nil {
+			return c.abortMultipartUpload(key, uploadID, err)
+		}
+		completedParts = append(completedParts, completedPart{
+			PartNumber: partNumber,
+			ETag:       etag,
+		})
+
+		if part, err = readPart(body, part, c.config.PartSize); err != nil {
+			return c.abortMultipartUpload(key, uploadID, err)
+		}
+	}
+
+	if err = c.completeMultipartUpload(key, uploadID, completedParts); err != nil {
+		return c.abortMultipartUpload(key, uploadID, err)
+	}
+
+	return nil
+}
+
+// Initial size of part buffer, buffer grows up to part size only for large objects
+const minPartBufferSize = 64 * 1024
+
+// Read up to size bytes to reused buffer, part is shorter than size only at the end of body
+func readPart(body io.Reader, buffer []byte, size int64) ([]byte, error) {
+	part := buffer[:0]
+	for int64(len(part)) < size {
+		if len(part) == cap(part) {
+			newSize := 2 * int64(cap(part))
+			if newSize < minPartBufferSize {
+				newSize = minPartBufferSize
+			}
+			if newSize > size {
+				newSize = size
+			}
+			part = append(make([]byte, 0, newSize), part...)
+		}
+
+		end := int64(cap(part))
+		if end > size {
+			end = size
+		}
+		length, err := body.Read(part[len(part):end])
+		part = part[:len(part)+length]
+		if err == io.EOF {
+			return part, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return part, nil
+}
+
+// Number of attempts to upload one part of multipart upload
+const partUploadAttempts = 3
+
+// Delay before next attempt to upload part, it is multiplied by number of failed attempts
+var partRetryDelay = time.Second
+
+// Upload part of multipart upload with retries and get its ETag
+func (c *Client) uploadPart(key string, uploadID string, partNumber int, part []byte) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(partNumber))
+	query.Set("uploadId", uploadID)
+
+	var err error
+	for attempt := 1; attempt <= partUploadAttempts; attempt++ {
+		var response *http.Response
+		response, err = c.do("PUT", key, query, bytes.NewReader(part), int64(len(part)))
+		if err == nil {
+			response.Body.Close()
+			return response.Header.Get("ETag"), nil
+		}
+		if attempt < partUploadAttempts {
+			time.Sleep(time.Duration(attempt) * partRetryDelay)
+		}
+	}
+
+	return "", fmt.Errorf("can't upload part %v after %v attempts, %v", partNumber, partUploadAttempts, err)
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Start multipart upload and get its ID
+func (c *Client) createMultipartUpload(key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	response, err := c.do("POST", key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if err = xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	return result.UploadID, nil
+}
+
+// Finish multipart upload with list of uploaded parts
+func (c *Client) completeMultipartUpload(key string, uploadID string, parts []completedPart) error {
+	content, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	response, err := c.do("POST", key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// S3 can return error with 200 status code
+	responseContent, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(responseContent, []byte("<Error>")) {
+		s3Error := &Error{StatusCode: response.StatusCode}
+		xml.Unmarshal(responseContent, s3Error)
+		return s3Error
+	}
+
+	return nil
+}
+
+// Cancel multipart upload and delete uploaded parts after err, errors of abort are added to err
+func (c *Client) abortMultipartUpload(key string, uploadID string, err error) error {
+	response, abortErr := c.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, 0)
+	if abortErr != nil {
+		return fmt.Errorf("%v, can't abort multipart upload %v, %v", err, uploadID, abortErr)
+	}
+	response.Body.Close()
+	return err
+}
+
+// Download object
+func (c *Client) GetObject(key string) (io.ReadCloser, error) {
+	response, err := c.do("GET", key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Get object size and modification time
+func (c *Client) StatObject(key string) (Object, error) {
+	response, err := c.do("HEAD", key, nil, nil, 0)
+	if err != nil {
+		return Object{}, err
+	}
+	response.Body.Close()
+
+	lastModified, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return Object{
+		Key:          key,
+		Size:         response.ContentLength,
+		LastModified: lastModified,
+	}, nil
+}
+
+// Delete object
+func (c *Client) DeleteObject(key string) error {
+	response, err := c.do("DELETE", key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// List all objects with prefix
+func (c *Client) ListObjects(prefix string) ([]Object, error) {
+	objects, _, err := c.listObjects(prefix, "")
+	return objects, err
+}
+
+// List objects with prefix without slash after prefix and common prefixes of other keys up to next slash
+func (c *Client) ListDirectory(prefix string) ([]Object, []string, error) {
+	return c.listObjects(prefix, "/")
+}
+
+// List objects with prefix by pages, keys with delimiter after prefix are grouped to common prefixes
+func (c *Client) listObjects(prefix string, delimiter string) ([]Object, []string, error) {
+	var (
+		result            []Object
+		commonPrefixes    []string
+		continuationToken string
+	)
+
+	for {
+		var page struct {
+			Contents       []Object `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		response, err := c.do("GET", "", query, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = xml.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		result = append(result, page.Contents...)
+		for _, commonPrefix := range page.CommonPrefixes {
+			commonPrefixes = append(commonPrefixes, commonPrefix.Prefix)
+		}
+		if !page.IsTruncated {
+			return result, commonPrefixes, nil
+		}
+		continuationToken = page.NextContinuationToken
+	}
+}
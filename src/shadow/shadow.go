@@ -0,0 +1,195 @@
+package shadow
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	logs "logging"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Prefix of shadow names created by backups
+const NamePrefix = "clickhousedump_"
+
+// Format of creation time in shadow name
+const timeFormat = "20060102T150405"
+
+// Shadow name used by older versions for every backup
+const LegacyName = "backup"
+
+// Create unique shadow name for backup run, name contains creation time, process ID and random suffix,
+// process ID is the same in different containers
+func NewName(now time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v%v_%v_%v", NamePrefix, now.UTC().Format(timeFormat), os.Getpid(), hex.EncodeToString(suffix)), nil
+}
+
+// Get creation time and process ID from shadow name, ok is false for other names
+func ParseName(name string) (createTime time.Time, pid int, ok bool) {
+	fields := strings.Split(strings.TrimPrefix(name, NamePrefix), "_")
+	if !strings.HasPrefix(name, NamePrefix) || len(fields) != 3 {
+		return time.Time{}, 0, false
+	}
+
+	createTime, err := time.Parse(timeFormat, fields[0])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	pid, err = strconv.Atoi(fields[1])
+	if err != nil || pid <= 0 {
+		return time.Time{}, 0, false
+	}
+
+	return createTime, pid, true
+}
+
+// Name of lock file held by running backup in its shadow directory
+const LockFileName = "clickhousedump.lock"
+
+// Error of shadow directory locked by running backup
+var ErrLocked = errors.New("shadow directory is locked by running backup")
+
+// Lock of shadow directory, released on Unlock or process exit
+type Lock struct {
+	file *os.File
+}
+
+// Create shadow directory with lock file and lock it, directories are owned
+// by owner of data directory to be writable by server
+func CreateLocked(sourceDirectory string, name string) (*Lock, error) {
+	dataInfo, err := os.Stat(sourceDirectory)
+	if err != nil {
+		return nil, err
+	}
+	owner := dataInfo.Sys().(*syscall.Stat_t)
+
+	for _, directory := range []string{sourceDirectory + "/shadow", sourceDirectory + "/shadow/" + name} {
+		err = os.Mkdir(directory, os.ModePerm)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if int(owner.Uid) != os.Geteuid() || int(owner.Gid) != os.Getegid() {
+			if err = os.Chown(directory, int(owner.Uid), int(owner.Gid)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	file, err := os.OpenFile(sourceDirectory+"/shadow/"+name+"/"+LockFileName, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(file)
+}
+
+// Lock shadow directory with existing lock file, error is ErrLocked when directory is locked by running backup
+func TryLock(directory string) (*Lock, error) {
+	file, err := os.Open(directory + "/" + LockFileName)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(file)
+}
+
+func lockFile(file *os.File) (*Lock, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, ErrLocked
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release lock
+func (l *Lock) Unlock() error {
+	return l.file.Close()
+}
+
+type CleanupStale struct {
+	SourceDirectory string
+	MinAge          time.Duration
+	Now             time.Time
+	DryRunFlag      bool
+	Result          []string
+}
+
+// Delete shadow directories which are not locked by running backup and which are older than MinAge,
+// directory with legacy name has no lock file and its age is age of last modification
+func (cs *CleanupStale) Run(ctx context.Context) error {
+	shadowDirectory := cs.SourceDirectory + "/shadow"
+
+	fileDescriptors, err := ioutil.ReadDir(shadowDirectory)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, fileDescriptor := range fileDescriptors {
+		createTime, _, ok := ParseName(fileDescriptor.Name())
+		if fileDescriptor.Name() == LegacyName {
+			createTime, ok = fileDescriptor.ModTime(), true
+		}
+		if !fileDescriptor.IsDir() || !ok {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = cs.cleanup(shadowDirectory+"/"+fileDescriptor.Name(), createTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete shadow directory holding its lock, so backup can't start using it
+func (cs *CleanupStale) cleanup(directory string, createTime time.Time) error {
+	name := path.Base(directory)
+
+	lock, err := TryLock(directory)
+	if err == ErrLocked {
+		logs.Info.Printf("keep %v, backup is running", name)
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if lock != nil {
+		defer lock.Unlock()
+	}
+
+	if cs.Now.Sub(createTime) < cs.MinAge {
+		logs.Info.Printf("keep %v created at %v", name, createTime.Format(time.RFC3339))
+		return nil
+	}
+
+	logs.Info.Printf("delete %v created at %v", name, createTime.Format(time.RFC3339))
+	if !cs.DryRunFlag {
+		if err = os.RemoveAll(directory); err != nil {
+			return err
+		}
+	}
+	cs.Result = append(cs.Result, name)
+	return nil
+}
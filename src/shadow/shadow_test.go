@@ -0,0 +1,128 @@
+package shadow
+
+import (
+	"context"
+	"io/ioutil"
+	logs "logging"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNewName(t *testing.T) {
+	now := time.Date(2020, 5, 1, 10, 20, 30, 0, time.UTC)
+	name, err := NewName(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherName, err := NewName(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name == otherName {
+		t.Errorf("got same names %v for one time and process", name)
+	}
+
+	createTime, pid, ok := ParseName(name)
+	if !ok || !createTime.Equal(now) || pid != os.Getpid() {
+		t.Errorf("got %v, %v, %v for %v, expected %v, %v, true", createTime, pid, ok, name, now, os.Getpid())
+	}
+}
+
+func TestParseName(t *testing.T) {
+	for _, name := range []string{
+		LegacyName,
+		"clickhousedump_20200501T102030_12",
+		"clickhousedump_20200501T102030_0_0a1b2c3d",
+		"clickhousedump_2020-05-01_12_0a1b2c3d",
+		"increment_20200501T102030_12_0a1b2c3d",
+	} {
+		if _, _, ok := ParseName(name); ok {
+			t.Errorf("got shadow name for %v, expected other name", name)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	directory, err := ioutil.TempDir("", "shadow_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	lock, err := CreateLocked(directory, "clickhousedump_20200501T102030_12_0a1b2c3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = TryLock(directory + "/shadow/clickhousedump_20200501T102030_12_0a1b2c3d"); err != ErrLocked {
+		t.Errorf("got %v, expected %v", err, ErrLocked)
+	}
+
+	if err = lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = TryLock(directory + "/shadow/clickhousedump_20200501T102030_12_0a1b2c3d")
+	if err != nil {
+		t.Fatalf("got %v, expected unlocked directory", err)
+	}
+	lock.Unlock()
+}
+
+func TestCleanupStale(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	directory, err := ioutil.TempDir("", "shadow_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{
+		"clickhousedump_20200501T100000_12_0a1b2c3d",
+		"clickhousedump_20200501T100000_1_4e5f6a7b",
+		"clickhousedump_20200501T115900_1_8c9d0e1f",
+	} {
+		lock, err := CreateLocked(directory, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// backup of first name is running
+		if name == "clickhousedump_20200501T100000_12_0a1b2c3d" {
+			defer lock.Unlock()
+		} else {
+			lock.Unlock()
+		}
+	}
+	for _, name := range []string{LegacyName, "other"} {
+		if err = os.Mkdir(directory+"/shadow/"+name, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(directory+"/shadow/"+name, now.Add(-2*time.Hour), now.Add(-2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmdCleanupStale := CleanupStale{SourceDirectory: directory, MinAge: time.Hour, Now: now}
+	if err = cmdCleanupStale.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(cmdCleanupStale.Result)
+	expected := []string{LegacyName, "clickhousedump_20200501T100000_1_4e5f6a7b"}
+	if len(cmdCleanupStale.Result) != len(expected) || cmdCleanupStale.Result[0] != expected[0] || cmdCleanupStale.Result[1] != expected[1] {
+		t.Fatalf("got %v, expected %v", cmdCleanupStale.Result, expected)
+	}
+
+	fileDescriptors, err := ioutil.ReadDir(directory + "/shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fileDescriptor := range fileDescriptors {
+		names = append(names, fileDescriptor.Name())
+	}
+	if len(names) != 3 {
+		t.Errorf("got shadow directories %v, expected 3", names)
+	}
+}
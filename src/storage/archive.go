@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"tarball"
+)
+
+// Write-only storage in archive stream, files are written one by one
+type Archive struct {
+	Writer *tarball.Writer
+	mutex  sync.Mutex
+}
+
+type archiveWriter struct {
+	io.WriteCloser
+	archive *Archive
+}
+
+// Release archive for next file
+func (aw *archiveWriter) Close() error {
+	defer aw.archive.mutex.Unlock()
+	return aw.WriteCloser.Close()
+}
+
+func (a *Archive) Put(name string, size int64) (io.WriteCloser, error) {
+	a.mutex.Lock()
+	writer, err := a.Writer.Create(name, size)
+	if err != nil {
+		a.mutex.Unlock()
+		return nil, err
+	}
+	return &archiveWriter{
+		WriteCloser: writer,
+		archive:     a,
+	}, nil
+}
+
+func (a *Archive) Get(name string) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (a *Archive) List(prefix string) ([]FileInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (a *Archive) ListDirectory(directory string) ([]FileInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (a *Archive) Delete(name string) error {
+	return ErrNotSupported
+}
+
+func (a *Archive) Stat(name string) (FileInfo, error) {
+	return FileInfo{}, ErrNotSupported
+}
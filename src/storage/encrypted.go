@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"crypt"
+	"io"
+	"strings"
+)
+
+// Storage wrapper which encrypts files on write and decrypts on read,
+// files from PlainFiles list are stored as is
+type Encrypted struct {
+	Storage
+	Key        *crypt.Key
+	PlainFiles []string
+}
+
+type encryptedWriter struct {
+	io.WriteCloser
+	destination io.WriteCloser
+}
+
+// Write last encrypted chunk and close destination file
+func (ew *encryptedWriter) Close() error {
+	if err := ew.WriteCloser.Close(); err != nil {
+		ew.destination.Close()
+		return err
+	}
+	return ew.destination.Close()
+}
+
+// Discard destination file without last chunk
+func (ew *encryptedWriter) CloseWithError(err error) error {
+	return AbortWriter(ew.destination, err)
+}
+
+type encryptedReader struct {
+	io.Reader
+	source io.Closer
+}
+
+func (er *encryptedReader) Close() error {
+	return er.source.Close()
+}
+
+func (e *Encrypted) isPlain(name string) bool {
+	for _, plainFile := range e.PlainFiles {
+		if name == plainFile {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Encrypted) Put(name string, size int64) (io.WriteCloser, error) {
+	if e.isPlain(name) {
+		return e.Storage.Put(name, size)
+	}
+
+	// size is not passed to storage, interrupted upload can't be resumed with new nonce
+	destination, err := e.Storage.Put(name, -1)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := crypt.NewWriter(destination, e.Key)
+	if err != nil {
+		destination.Close()
+		return nil, err
+	}
+
+	return &encryptedWriter{
+		WriteCloser: writer,
+		destination: destination,
+	}, nil
+}
+
+func (e *Encrypted) Get(name string) (io.ReadCloser, error) {
+	source, err := e.Storage.Get(name)
+	if err != nil || e.isPlain(name) {
+		return source, err
+	}
+
+	reader, err := crypt.NewReader(source, e.Key)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	return &encryptedReader{
+		Reader: reader,
+		source: source,
+	}, nil
+}
+
+// Sizes of encrypted files are sizes of plain data
+func (e *Encrypted) List(prefix string) ([]FileInfo, error) {
+	files, err := e.Storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if !e.isPlain(files[i].Name) {
+			files[i].Size = crypt.PlainSize(files[i].Size)
+		}
+	}
+	return files, nil
+}
+
+func (e *Encrypted) ListDirectory(directory string) ([]FileInfo, error) {
+	files, err := e.Storage.ListDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if !strings.HasSuffix(files[i].Name, "/") && !e.isPlain(files[i].Name) {
+			files[i].Size = crypt.PlainSize(files[i].Size)
+		}
+	}
+	return files, nil
+}
+
+func (e *Encrypted) Stat(name string) (FileInfo, error) {
+	fileInfo, err := e.Storage.Stat(name)
+	if err == nil && !e.isPlain(name) {
+		fileInfo.Size = crypt.PlainSize(fileInfo.Size)
+	}
+	return fileInfo, err
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fileutils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Storage in local directory
+type Local struct {
+	Directory string
+}
+
+type localWriter struct {
+	*os.File
+	temporaryName string
+	name          string
+}
+
+// Rename temporary file to final name after successful write
+func (lw *localWriter) Close() error {
+	if err := lw.File.Close(); err != nil {
+		os.Remove(lw.temporaryName)
+		return err
+	}
+	return os.Rename(lw.temporaryName, lw.name)
+}
+
+// Remove temporary file of incomplete write
+func (lw *localWriter) CloseWithError(err error) error {
+	lw.File.Close()
+	os.Remove(lw.temporaryName)
+	return err
+}
+
+func (l *Local) path(name string) string {
+	return path.Join(l.Directory, name)
+}
+
+func (l *Local) Put(name string, size int64) (io.WriteCloser, error) {
+	filePath := l.path(name)
+	if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(filePath + temporarySuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWriter{
+		File:          file,
+		temporaryName: filePath + temporarySuffix,
+		name:          filePath,
+	}, nil
+}
+
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *Local) List(prefix string) ([]FileInfo, error) {
+	var result []FileInfo
+
+	// walk from directory part of prefix
+	root := l.path(prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		root = path.Dir(root)
+	}
+
+	err := filepath.Walk(root, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name, err := filepath.Rel(l.Directory, filePath)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if !fileInfo.IsDir() && strings.HasPrefix(name, prefix) && !isTemporary(name) {
+			result = append(result, FileInfo{
+				Name:    name,
+				Size:    fileInfo.Size(),
+				ModTime: fileInfo.ModTime(),
+			})
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func (l *Local) ListDirectory(directory string) ([]FileInfo, error) {
+	entries, err := ioutil.ReadDir(l.path(directory))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return directoryEntries(directory, entries), nil
+}
+
+func (l *Local) Delete(name string) error {
+	return os.RemoveAll(l.path(name))
+}
+
+func (l *Local) Stat(name string) (FileInfo, error) {
+	fileInfo, err := os.Stat(l.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Name:    name,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}, nil
+}
+
+func (l *Local) LinkDirectory(sourceDirectory string, name string) error {
+	return fileutils.LinkDirectory(sourceDirectory, l.path(name))
+}
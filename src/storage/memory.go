@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Storage of files in memory, used for small files as metadata read from archive
+type Memory struct {
+	files map[string][]byte
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	memory *Memory
+	name   string
+}
+
+func (mw *memoryWriter) Close() error {
+	if mw.memory.files == nil {
+		mw.memory.files = make(map[string][]byte)
+	}
+	mw.memory.files[mw.name] = mw.Bytes()
+	return nil
+}
+
+// Discard incomplete file
+func (mw *memoryWriter) CloseWithError(err error) error {
+	return err
+}
+
+func (m *Memory) Put(name string, size int64) (io.WriteCloser, error) {
+	return &memoryWriter{memory: m, name: name}, nil
+}
+
+func (m *Memory) Get(name string) (io.ReadCloser, error) {
+	content, ok := m.files[name]
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (m *Memory) List(prefix string) ([]FileInfo, error) {
+	var result []FileInfo
+	for name, content := range m.files {
+		if strings.HasPrefix(name, prefix) {
+			result = append(result, FileInfo{Name: name, Size: int64(len(content))})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (m *Memory) ListDirectory(directory string) ([]FileInfo, error) {
+	var result []FileInfo
+
+	prefix := directoryPrefix(directory)
+	files, err := m.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	for _, file := range files {
+		// files of sub directories are listed as sub directory
+		if slash := strings.Index(file.Name[len(prefix):], "/"); slash >= 0 {
+			file = FileInfo{Name: file.Name[:len(prefix)+slash+1]}
+		}
+		if !listed[file.Name] {
+			listed[file.Name] = true
+			result = append(result, file)
+		}
+	}
+	return result, nil
+}
+
+func (m *Memory) Delete(name string) error {
+	for fileName := range m.files {
+		if fileName == name || strings.HasPrefix(fileName, directoryPrefix(name)) {
+			delete(m.files, fileName)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Stat(name string) (FileInfo, error) {
+	content, ok := m.files[name]
+	if !ok {
+		return FileInfo{}, ErrNotExist
+	}
+	return FileInfo{Name: name, Size: int64(len(content))}, nil
+}
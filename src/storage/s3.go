@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"io"
+	"path"
+	"s3"
+	"strings"
+)
+
+// Storage in S3 bucket under key prefix
+type S3 struct {
+	Client *s3.Client
+	Prefix string
+}
+
+type s3Writer struct {
+	*io.PipeWriter
+	done chan error
+}
+
+// Wait for upload result
+func (sw *s3Writer) Close() error {
+	sw.PipeWriter.Close()
+	return <-sw.done
+}
+
+// Cancel upload, multipart upload is aborted by client on read error
+// and errors of abort are returned with err
+func (sw *s3Writer) CloseWithError(err error) error {
+	sw.PipeWriter.CloseWithError(err)
+	if uploadErr := <-sw.done; uploadErr != nil {
+		return uploadErr
+	}
+	return err
+}
+
+func (st *S3) key(name string) string {
+	return path.Join(st.Prefix, name)
+}
+
+func (st *S3) Put(name string, size int64) (io.WriteCloser, error) {
+	reader, writer := io.Pipe()
+	result := &s3Writer{
+		PipeWriter: writer,
+		done:       make(chan error, 1),
+	}
+
+	go func() {
+		err := st.Client.PutObject(st.key(name), reader, size)
+		reader.CloseWithError(err)
+		result.done <- err
+	}()
+
+	return result, nil
+}
+
+func (st *S3) Get(name string) (io.ReadCloser, error) {
+	reader, err := st.Client.GetObject(st.key(name))
+	if s3.IsNotFound(err) {
+		return nil, ErrNotExist
+	}
+	return reader, err
+}
+
+// Get key prefix for file name prefix, prefix of directory ends with slash
+func (st *S3) keyPrefix(prefix string) string {
+	keyPrefix := st.key(prefix)
+	if strings.HasSuffix(prefix, "/") || prefix == "" {
+		keyPrefix = strings.TrimSuffix(keyPrefix, "/") + "/"
+	}
+	if keyPrefix == "/" {
+		keyPrefix = ""
+	}
+	return keyPrefix
+}
+
+// Get file name of object key
+func (st *S3) name(key string) string {
+	if st.Prefix != "" {
+		return strings.TrimPrefix(key, strings.TrimSuffix(st.Prefix, "/")+"/")
+	}
+	return key
+}
+
+func (st *S3) List(prefix string) ([]FileInfo, error) {
+	var result []FileInfo
+
+	objects, err := st.Client.ListObjects(st.keyPrefix(prefix))
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		result = append(result, FileInfo{
+			Name:    st.name(object.Key),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+
+	return result, nil
+}
+
+func (st *S3) ListDirectory(directory string) ([]FileInfo, error) {
+	var result []FileInfo
+
+	objects, commonPrefixes, err := st.Client.ListDirectory(st.keyPrefix(directoryPrefix(directory)))
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		result = append(result, FileInfo{
+			Name:    st.name(object.Key),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+	for _, commonPrefix := range commonPrefixes {
+		result = append(result, FileInfo{Name: st.name(commonPrefix)})
+	}
+
+	return result, nil
+}
+
+func (st *S3) Delete(name string) error {
+	// delete object and all objects in "directory"
+	objects, err := st.List(name + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err = st.Client.DeleteObject(st.key(object.Name)); err != nil {
+			return err
+		}
+	}
+
+	err = st.Client.DeleteObject(st.key(name))
+	if s3.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (st *S3) Stat(name string) (FileInfo, error) {
+	object, err := st.Client.StatObject(st.key(name))
+	if s3.IsNotFound(err) {
+		return FileInfo{}, ErrNotExist
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Name:    name,
+		Size:    object.Size,
+		ModTime: object.LastModified,
+	}, nil
+}
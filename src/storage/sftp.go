@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPConfig struct {
+	Address        string
+	User           string
+	KeyFile        string
+	KnownHostsFile string
+}
+
+// Storage in directory of remote host over SFTP
+type SFTP struct {
+	Client     *sftp.Client
+	Directory  string
+	connection *ssh.Client
+}
+
+// Connect to remote host with private key, host key is checked with known_hosts file
+func DialSFTP(config SFTPConfig, directory string) (*SFTP, error) {
+	key, err := ioutil.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse private key %v, %v", config.KeyFile, err)
+	}
+
+	hostKeyCallback, err := knownhosts.New(config.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	address := config.Address
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	connection, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(connection)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+
+	return &SFTP{
+		Client:     client,
+		Directory:  directory,
+		connection: connection,
+	}, nil
+}
+
+// Close SFTP session and SSH connection
+func (st *SFTP) Close() error {
+	err := st.Client.Close()
+	if st.connection != nil {
+		st.connection.Close()
+	}
+	return err
+}
+
+// Open sub directory as separate storage over the same connection
+func (st *SFTP) Sub(directory string) *SFTP {
+	return &SFTP{
+		Client:     st.Client,
+		Directory:  path.Join(st.Directory, directory),
+		connection: st.connection,
+	}
+}
+
+type sftpWriter struct {
+	*sftp.File
+	client        *sftp.Client
+	temporaryName string
+	name          string
+	size          int64
+	written       int64
+	skip          int64
+}
+
+// Skip data already uploaded by interrupted upload, skipped data is compared with temporary file
+// and upload is continued from first difference
+func (sw *sftpWriter) Write(data []byte) (int, error) {
+	length := len(data)
+	offset := sw.written
+	sw.written += int64(length)
+
+	if sw.skip > 0 {
+		skipped := sw.skip
+		if skipped > int64(length) {
+			skipped = int64(length)
+		}
+		uploaded := make([]byte, skipped)
+		// read of whole chunk may end with io.EOF at end of temporary file
+		if read, _ := sw.File.ReadAt(uploaded, offset); read == len(uploaded) && bytes.Equal(uploaded, data[:skipped]) {
+			sw.skip -= skipped
+			data = data[skipped:]
+		} else {
+			// temporary file is of other content, it is written again from this chunk
+			sw.skip = 0
+			if err := sw.File.Truncate(offset); err != nil {
+				return 0, err
+			}
+			if _, err := sw.File.Seek(offset, io.SeekStart); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(data) == 0 {
+		return length, nil
+	}
+
+	written, err := sw.File.Write(data)
+	return length - len(data) + written, err
+}
+
+// Keep temporary file of failed upload for resume, upload of unknown size can't be resumed
+func (sw *sftpWriter) CloseWithError(err error) error {
+	sw.File.Close()
+	if sw.size < 0 {
+		if removeErr := sw.client.Remove(sw.temporaryName); removeErr != nil {
+			return fmt.Errorf("%v, can't remove temporary file %v, %v", err, sw.temporaryName, removeErr)
+		}
+	}
+	return err
+}
+
+// Rename temporary file to final name after complete upload,
+// incomplete temporary file is kept to resume upload
+func (sw *sftpWriter) Close() error {
+	if err := sw.File.Close(); err != nil {
+		return err
+	}
+	if sw.size >= 0 && sw.written != sw.size {
+		return fmt.Errorf("%v: written %v bytes, expected %v", sw.name, sw.written, sw.size)
+	}
+
+	if err := sw.client.PosixRename(sw.temporaryName, sw.name); err != nil {
+		// server without posix-rename extension
+		sw.client.Remove(sw.name)
+		return sw.client.Rename(sw.temporaryName, sw.name)
+	}
+	return nil
+}
+
+func (st *SFTP) path(name string) string {
+	return path.Join(st.Directory, name)
+}
+
+func (st *SFTP) Put(name string, size int64) (io.WriteCloser, error) {
+	filePath := st.path(name)
+	if err := st.Client.MkdirAll(path.Dir(filePath)); err != nil {
+		return nil, err
+	}
+
+	writer := &sftpWriter{
+		client:        st.Client,
+		temporaryName: filePath + temporarySuffix,
+		name:          filePath,
+		size:          size,
+	}
+
+	// resume upload of file with known size
+	if size > 0 {
+		if fileInfo, err := st.Client.Stat(writer.temporaryName); err == nil && fileInfo.Size() <= size {
+			writer.skip = fileInfo.Size()
+		}
+	}
+
+	file, err := st.Client.OpenFile(writer.temporaryName, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	if writer.skip > 0 {
+		_, err = file.Seek(writer.skip, io.SeekStart)
+	} else {
+		err = file.Truncate(0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	writer.File = file
+	return writer, nil
+}
+
+func (st *SFTP) Get(name string) (io.ReadCloser, error) {
+	file, err := st.Client.Open(st.path(name))
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return file, nil
+}
+
+func (st *SFTP) List(prefix string) ([]FileInfo, error) {
+	var result []FileInfo
+
+	// walk from directory part of prefix
+	root := st.path(prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		root = path.Dir(root)
+	}
+
+	walker := st.Client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean(walker.Path()), path.Clean(st.Directory)+"/")
+		if !walker.Stat().IsDir() && strings.HasPrefix(name, prefix) && !isTemporary(name) {
+			result = append(result, FileInfo{
+				Name:    name,
+				Size:    walker.Stat().Size(),
+				ModTime: walker.Stat().ModTime(),
+			})
+		}
+	}
+
+	return result, nil
+}
+
+func (st *SFTP) ListDirectory(directory string) ([]FileInfo, error) {
+	entries, err := st.Client.ReadDir(st.path(directory))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return directoryEntries(directory, entries), nil
+}
+
+func (st *SFTP) Delete(name string) error {
+	err := st.Client.RemoveAll(st.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (st *SFTP) Stat(name string) (FileInfo, error) {
+	fileInfo, err := st.Client.Stat(st.path(name))
+	if err != nil {
+		return FileInfo{}, sftpError(err)
+	}
+	return FileInfo{
+		Name:    name,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}, nil
+}
+
+func sftpError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	return err
+}
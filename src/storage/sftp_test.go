@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// In-process SSH server with SFTP subsystem serving local file system
+type testSFTPServer struct {
+	listener  net.Listener
+	directory string
+	config    SFTPConfig
+}
+
+func newTestSigner(t *testing.T) (ssh.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func startSFTPServer(t *testing.T) *testSFTPServer {
+	directory, err := ioutil.TempDir("", "sftp_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, _ := newTestSigner(t)
+	clientSigner, clientKey := newTestSigner(t)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(connection, config)
+		}
+	}()
+
+	keyFile := path.Join(directory, "id_ecdsa")
+	knownHostsFile := path.Join(directory, "known_hosts")
+	if err = ioutil.WriteFile(keyFile, clientKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsLine := knownhosts.Line([]string{listener.Addr().String()}, hostSigner.PublicKey())
+	if err = ioutil.WriteFile(knownHostsFile, []byte(knownHostsLine+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testSFTPServer{
+		listener:  listener,
+		directory: directory,
+		config: SFTPConfig{
+			Address:        listener.Addr().String(),
+			User:           "test",
+			KeyFile:        keyFile,
+			KnownHostsFile: knownHostsFile,
+		},
+	}
+}
+
+func serveSFTP(connection net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(connection, config)
+	if err != nil {
+		connection.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				// subsystem payload is length prefixed name
+				isSFTP := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+				request.Reply(isSFTP, nil)
+				if isSFTP {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+					server.Serve()
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func (ts *testSFTPServer) close() {
+	ts.listener.Close()
+	os.RemoveAll(ts.directory)
+}
+
+// Connect to test server, backups are in "backups" sub directory
+func (ts *testSFTPServer) dial(t *testing.T) *SFTP {
+	storage, err := DialSFTP(ts.config, path.Join(ts.directory, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func (ts *testSFTPServer) readFile(t *testing.T, name string) []byte {
+	content, err := ioutil.ReadFile(path.Join(ts.directory, "backups", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestSFTPPutGetList(t *testing.T) {
+	server := startSFTPServer(t)
+	defer server.close()
+	storage := server.dial(t)
+	defer storage.Close()
+
+	files := map[string]string{
+		"backup/manifest.json":                 "{}",
+		"backup/metadata/db/table.sql":         "CREATE TABLE table",
+		"backup/partitions/db/table/1_1_1_0/a": "part file",
+		"backup/partitions/db/table/2_2_2_0/a": "other part file",
+		"other/partitions/db/table/1_1_1_0/a":  "other backup",
+	}
+	for name, content := range files {
+		if err := PutBytes(storage, name, []byte(content)); err != nil {
+			t.Fatalf("put %v: %v", name, err)
+		}
+	}
+
+	for name, content := range files {
+		got, err := GetBytes(storage, name)
+		if err != nil {
+			t.Fatalf("get %v: %v", name, err)
+		}
+		if string(got) != content {
+			t.Errorf("get %v: got %q, expected %q", name, got, content)
+		}
+	}
+
+	listed, err := storage.List("backup/partitions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 {
+		t.Errorf("list backup/partitions/: got %v files, expected 2", len(listed))
+	}
+	for _, file := range listed {
+		if int64(len(files[file.Name])) != file.Size {
+			t.Errorf("list: %v has size %v, expected %v", file.Name, file.Size, len(files[file.Name]))
+		}
+	}
+
+	entries, err := storage.ListDirectory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "backup/,other/" {
+		t.Errorf("list directory: got %v", names)
+	}
+	if entries, err = storage.ListDirectory("backup/partitions/db/table"); len(entries) != 2 || err != nil {
+		t.Errorf("list directory backup/partitions/db/table: got %v (%v)", entries, err)
+	}
+	if entries, err = storage.ListDirectory("missing"); len(entries) != 0 || err != nil {
+		t.Errorf("list missing directory: got %v (%v)", entries, err)
+	}
+
+	if _, err = storage.Stat("backup/missing"); !IsNotExist(err) {
+		t.Errorf("stat of missing file: got %v, expected not exist error", err)
+	}
+	if err = storage.Delete("backup"); err != nil {
+		t.Fatal(err)
+	}
+	if listed, _ = storage.List("backup/"); len(listed) != 0 {
+		t.Errorf("list after delete: got %v files", len(listed))
+	}
+}
+
+func TestSFTPResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+
+	tests := []struct {
+		name      string
+		temporary []byte
+	}{
+		{"no temporary file", nil},
+		{"uploaded prefix", content[:31234]},
+		{"complete temporary file", content},
+		{"stale prefix of other file", append(append([]byte{}, content[:4000]...), bytes.Repeat([]byte("x"), 3000)...)},
+		{"stale first chunk", bytes.Repeat([]byte("x"), 500)},
+	}
+
+	server := startSFTPServer(t)
+	defer server.close()
+	storage := server.dial(t)
+	defer storage.Close()
+
+	for _, test := range tests {
+		name := "resume/file"
+		if test.temporary != nil {
+			if err := os.MkdirAll(path.Join(server.directory, "backups", "resume"), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path.Join(server.directory, "backups", name+".tmp"), test.temporary, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		writer, err := storage.Put(name, int64(len(content)))
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		// write in chunks not aligned with uploaded prefix
+		for offset := 0; offset < len(content); offset += 3000 {
+			end := offset + 3000
+			if end > len(content) {
+				end = len(content)
+			}
+			if _, err = writer.Write(content[offset:end]); err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+		}
+		if err = writer.Close(); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		if got := server.readFile(t, name); !bytes.Equal(got, content) {
+			t.Errorf("%v: uploaded file differs from written data", test.name)
+		}
+		if _, err = os.Stat(path.Join(server.directory, "backups", name+".tmp")); !os.IsNotExist(err) {
+			t.Errorf("%v: temporary file is not removed", test.name)
+		}
+	}
+}
+
+func TestSFTPFailedUploadIsKept(t *testing.T) {
+	server := startSFTPServer(t)
+	defer server.close()
+	storage := server.dial(t)
+	defer storage.Close()
+
+	writer, err := storage.Put("failed/file", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	AbortWriter(writer, io.ErrUnexpectedEOF)
+
+	if got := server.readFile(t, "failed/file.tmp"); string(got) != "partial" {
+		t.Errorf("temporary file of failed upload: got %q", got)
+	}
+	if _, err = storage.Stat("failed/file"); !IsNotExist(err) {
+		t.Errorf("failed upload is saved: %v", err)
+	}
+
+	// temporary file is not listed as backup file
+	for _, list := range []func() ([]FileInfo, error){
+		func() ([]FileInfo, error) { return storage.List("failed/") },
+		func() ([]FileInfo, error) { return storage.ListDirectory("failed") },
+	} {
+		files, err := list()
+		if err != nil || len(files) > 0 {
+			t.Errorf("got listed files %v (%v), expected none", files, err)
+		}
+	}
+}
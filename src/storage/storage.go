@@ -0,0 +1,391 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors of storages
+var (
+	ErrNotExist     = errors.New("file does not exist")
+	ErrNotSupported = errors.New("operation is not supported by storage")
+)
+
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backup storage, file names are slash separated paths relative to storage root
+type Storage interface {
+	// Create file with known size, file is complete after successful Close
+	Put(name string, size int64) (io.WriteCloser, error)
+	// Open file for reading
+	Get(name string) (io.ReadCloser, error)
+	// Recursive list files with name prefix
+	List(prefix string) ([]FileInfo, error)
+	// List files and sub directories of directory, names of sub directories end with slash
+	ListDirectory(directory string) ([]FileInfo, error)
+	// Delete file or directory with all files
+	Delete(name string) error
+	// Get file info
+	Stat(name string) (FileInfo, error)
+}
+
+// Storage able to hardlink local directory instead of copy
+type Linker interface {
+	LinkDirectory(sourceDirectory string, name string) error
+}
+
+// Check error is "file does not exist"
+func IsNotExist(err error) bool {
+	return err == ErrNotExist || os.IsNotExist(err)
+}
+
+// Writer able to discard incomplete file instead of saving it on Close
+type aborter interface {
+	CloseWithError(err error) error
+}
+
+// Close writer after failed write, incomplete file is discarded when storage supports it,
+// errors of discarding are added to err
+func AbortWriter(writer io.WriteCloser, err error) error {
+	if abortable, ok := writer.(aborter); ok {
+		return abortable.CloseWithError(err)
+	}
+	writer.Close()
+	return err
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (cr *contextReader) Read(data []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(data)
+}
+
+// Stop reading with context error after context is canceled
+func ContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, reader: reader}
+}
+
+// Upload local file to storage
+func PutFile(ctx context.Context, destination Storage, sourceFile string, name string) error {
+	file, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return PutReader(destination, name, fileInfo.Size(), ContextReader(ctx, file))
+}
+
+// Upload content to storage
+func PutBytes(destination Storage, name string, content []byte) error {
+	return PutReader(destination, name, int64(len(content)), bytes.NewReader(content))
+}
+
+// Upload stream with known size to storage, file is discarded on read error
+func PutReader(destination Storage, name string, size int64, content io.Reader) error {
+	writer, err := destination.Put(name, size)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(writer, content); err != nil {
+		return AbortWriter(writer, err)
+	}
+
+	return writer.Close()
+}
+
+// Recursive upload local directory to storage, skip files by filter
+func PutDirectory(ctx context.Context, destination Storage, sourceDirectory string, name string, skip func(fileName string) bool) error {
+	fileDescriptors, err := ioutil.ReadDir(sourceDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, fileDescriptor := range fileDescriptors {
+		if skip != nil && skip(fileDescriptor.Name()) {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		sourcePath := path.Join(sourceDirectory, fileDescriptor.Name())
+		destinationName := path.Join(name, fileDescriptor.Name())
+		if fileDescriptor.IsDir() {
+			err = PutDirectory(ctx, destination, sourcePath, destinationName, skip)
+		} else {
+			err = PutFile(ctx, destination, sourcePath, destinationName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read whole file from storage
+func GetBytes(source Storage, name string) ([]byte, error) {
+	reader, err := source.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// Download file from storage to local file
+func GetFile(ctx context.Context, source Storage, name string, destinationFile string) error {
+	if err := os.MkdirAll(path.Dir(destinationFile), os.ModePerm); err != nil {
+		return err
+	}
+
+	reader, err := source.Get(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	file, err := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	// write errors may be reported only by close
+	_, err = io.Copy(file, ContextReader(ctx, reader))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Download all files of storage directory to local directory
+func GetDirectory(ctx context.Context, source Storage, name string, destinationDirectory string) error {
+	files, err := source.List(name + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err = GetFile(ctx, source, file.Name, path.Join(destinationDirectory, strings.TrimPrefix(file.Name, name+"/")))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Storage with files known only by names, listed files can't be read
+type Listing struct {
+	Storage
+	Files []FileInfo
+}
+
+func (ls *Listing) List(prefix string) ([]FileInfo, error) {
+	result, err := ls.Storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range ls.Files {
+		if strings.HasPrefix(file.Name, prefix) {
+			result = append(result, file)
+		}
+	}
+	return result, nil
+}
+
+func (ls *Listing) ListDirectory(directory string) ([]FileInfo, error) {
+	result, err := ls.Storage.ListDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	for _, file := range result {
+		listed[file.Name] = true
+	}
+
+	prefix := directoryPrefix(directory)
+	for _, file := range ls.Files {
+		if !strings.HasPrefix(file.Name, prefix) {
+			continue
+		}
+		// files of sub directories are listed as sub directory
+		if slash := strings.Index(file.Name[len(prefix):], "/"); slash >= 0 {
+			file = FileInfo{Name: file.Name[:len(prefix)+slash+1]}
+		}
+		if !listed[file.Name] {
+			listed[file.Name] = true
+			result = append(result, file)
+		}
+	}
+	return result, nil
+}
+
+// Get name prefix of files in directory, root directory is empty string
+func directoryPrefix(directory string) string {
+	directory = strings.Trim(directory, "/")
+	if directory == "" {
+		return ""
+	}
+	return directory + "/"
+}
+
+// Suffix of files written by Put before they are complete
+const temporarySuffix = ".tmp"
+
+// Check file is incomplete temporary file, such files are not listed
+func isTemporary(name string) bool {
+	return strings.HasSuffix(name, temporarySuffix)
+}
+
+// Convert entries of directory to file infos, names of sub directories end with slash,
+// temporary files are skipped
+func directoryEntries(directory string, entries []os.FileInfo) []FileInfo {
+	var result []FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			result = append(result, FileInfo{
+				Name:    directoryPrefix(directory) + entry.Name() + "/",
+				ModTime: entry.ModTime(),
+			})
+		} else if !isTemporary(entry.Name()) {
+			result = append(result, FileInfo{
+				Name:    directoryPrefix(directory) + entry.Name(),
+				Size:    entry.Size(),
+				ModTime: entry.ModTime(),
+			})
+		}
+	}
+	return result
+}
+
+type RecordedFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// Storage wrapper which records names, sizes and checksums of written files
+type Recorder struct {
+	Storage
+	mutex  sync.Mutex
+	Files  []RecordedFile
+	Linked []string
+}
+
+type recordWriter struct {
+	io.WriteCloser
+	recorder *Recorder
+	name     string
+	size     int64
+	hash     hash.Hash
+}
+
+func (rw *recordWriter) Write(data []byte) (int, error) {
+	written, err := rw.WriteCloser.Write(data)
+	rw.hash.Write(data[:written])
+	rw.size += int64(written)
+	return written, err
+}
+
+func (rw *recordWriter) Close() error {
+	if err := rw.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	rw.recorder.mutex.Lock()
+	defer rw.recorder.mutex.Unlock()
+	rw.recorder.Files = append(rw.recorder.Files, RecordedFile{
+		Name:   rw.name,
+		Size:   rw.size,
+		SHA256: hex.EncodeToString(rw.hash.Sum(nil)),
+	})
+	return nil
+}
+
+// Discard file without recording it
+func (rw *recordWriter) CloseWithError(err error) error {
+	return AbortWriter(rw.WriteCloser, err)
+}
+
+func (r *Recorder) Put(name string, size int64) (io.WriteCloser, error) {
+	writer, err := r.Storage.Put(name, size)
+	if err != nil {
+		return nil, err
+	}
+	return &recordWriter{
+		WriteCloser: writer,
+		recorder:    r,
+		name:        name,
+		hash:        sha256.New(),
+	}, nil
+}
+
+// Delete file or directory and forget its recorded files and linked directories
+func (r *Recorder) Delete(name string) error {
+	if err := r.Storage.Delete(name); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	files := r.Files[:0]
+	for _, file := range r.Files {
+		if file.Name != name && !strings.HasPrefix(file.Name, name+"/") {
+			files = append(files, file)
+		}
+	}
+	r.Files = files
+
+	linked := r.Linked[:0]
+	for _, directory := range r.Linked {
+		if directory != name && !strings.HasPrefix(directory, name+"/") {
+			linked = append(linked, directory)
+		}
+	}
+	r.Linked = linked
+	return nil
+}
+
+func (r *Recorder) LinkDirectory(sourceDirectory string, name string) error {
+	linker, ok := r.Storage.(Linker)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := linker.LinkDirectory(sourceDirectory, name); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Linked = append(r.Linked, name)
+	return nil
+}
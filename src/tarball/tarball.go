@@ -0,0 +1,235 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	logs "logging"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Supported compression formats
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+)
+
+// File name extensions of archives, encrypted archives can have .enc extension added
+var archiveExtensions = []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tzst", ".tar.lz4"}
+
+// Magic bytes of compressed streams
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicLZ4  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+// Check file name has archive extension
+func IsArchiveName(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".enc")
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+type Writer struct {
+	compressor io.WriteCloser
+	tar        *tar.Writer
+	// error of incomplete file, tar stream is broken after it
+	err error
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Create archive writer with compression
+func NewWriter(destination io.Writer, compression string) (*Writer, error) {
+	var (
+		err        error
+		compressor io.WriteCloser
+	)
+
+	switch compression {
+	case CompressionNone:
+		compressor = nopWriteCloser{destination}
+	case CompressionGzip:
+		compressor = gzip.NewWriter(destination)
+	case CompressionZstd:
+		if compressor, err = zstd.NewWriter(destination); err != nil {
+			return nil, err
+		}
+	case CompressionLZ4:
+		compressor = lz4.NewWriter(destination)
+	default:
+		return nil, fmt.Errorf("unknown compression %v", compression)
+	}
+
+	return &Writer{
+		compressor: compressor,
+		tar:        tar.NewWriter(compressor),
+	}, nil
+}
+
+type fileWriter struct {
+	archive *Writer
+	name    string
+	size    int64
+	written int64
+}
+
+func (fw *fileWriter) Write(data []byte) (int, error) {
+	written, err := fw.archive.tar.Write(data)
+	fw.written += int64(written)
+	if err != nil {
+		fw.archive.err = fmt.Errorf("archive %v: %v", fw.name, err)
+	}
+	return written, err
+}
+
+// Check all declared bytes are written, archive can't be continued after incomplete file
+func (fw *fileWriter) Close() error {
+	if fw.written != fw.size {
+		fw.archive.err = fmt.Errorf("archive %v: written %v bytes of %v", fw.name, fw.written, fw.size)
+		return fw.archive.err
+	}
+	return fw.archive.tar.Flush()
+}
+
+// Add file with known size to archive, only one file can be written at the same time
+func (w *Writer) Create(name string, size int64) (io.WriteCloser, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	err := w.tar.WriteHeader(&tar.Header{
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		w.err = err
+		return nil, err
+	}
+
+	return &fileWriter{
+		archive: w,
+		name:    name,
+		size:    size,
+	}, nil
+}
+
+// Flush archive and compressed stream, archive with incomplete file is not finished
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.tar.Close(); err != nil {
+		return err
+	}
+	return w.compressor.Close()
+}
+
+// Detect compression of archive stream
+func decompress(source *bufio.Reader) (io.Reader, func(), error) {
+	magic, err := source.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		reader, err := gzip.NewReader(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	case bytes.HasPrefix(magic, magicZstd):
+		reader, err := zstd.NewReader(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, reader.Close, nil
+	case bytes.HasPrefix(magic, magicLZ4):
+		return lz4.NewReader(source), func() {}, nil
+	}
+
+	return source, func() {}, nil
+}
+
+// Read regular files of archive stream, filter selects files passed to read with their content,
+// names in headers are cleaned
+func Read(source io.Reader, filter func(name string) bool, read func(header *tar.Header, content io.Reader) error) error {
+	reader, closeReader, err := decompress(bufio.NewReader(source))
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+		if header.Typeflag != tar.TypeReg || (filter != nil && !filter(name)) {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("wrong file name %v in archive", header.Name)
+		}
+		header.Name = name
+		if err = read(header, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// Extract files from archive stream to directory, filter selects files to extract
+func Extract(source io.Reader, destinationDirectory string, filter func(name string) bool) error {
+	return Read(source, filter, func(header *tar.Header, content io.Reader) error {
+		destinationFile := path.Join(destinationDirectory, header.Name)
+		logs.Trace.Printf("extract %v", destinationFile)
+		if err := os.MkdirAll(path.Dir(destinationFile), os.ModePerm); err != nil {
+			return err
+		}
+		return extractFile(content, destinationFile, os.FileMode(header.Mode).Perm())
+	})
+}
+
+// Write single file from archive
+func extractFile(source io.Reader, destinationFile string, mode os.FileMode) error {
+	file, err := os.OpenFile(destinationFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	// write errors may be reported only by close
+	_, err = io.Copy(file, source)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package tarball
+
+import (
+	"bytes"
+	"io/ioutil"
+	logs "logging"
+	"os"
+	"testing"
+)
+
+// Write archive with files, sizes of files are sizes of their contents
+func testArchive(t *testing.T, compression string, files map[string]string) []byte {
+	var archive bytes.Buffer
+	writer, err := NewWriter(&archive, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		file, err := writer.Create(name, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = file.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err = file.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	files := map[string]string{
+		"metadata/db/events.sql":                "CREATE TABLE events",
+		"partitions/db/events/1_1_1_0/data.bin": "data",
+		"metadata/other/users.sql":              "CREATE TABLE users",
+	}
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd, CompressionLZ4} {
+		archive := testArchive(t, compression, files)
+
+		directory, err := ioutil.TempDir("", "tarball_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(directory)
+
+		err = Extract(bytes.NewReader(archive), directory, func(name string) bool {
+			return name != "metadata/other/users.sql"
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", compression, err)
+		}
+		for name, content := range files {
+			extracted, err := ioutil.ReadFile(directory + "/" + name)
+			if name == "metadata/other/users.sql" {
+				if !os.IsNotExist(err) {
+					t.Errorf("%v: got %v extracted, expected skipped by filter", compression, name)
+				}
+				continue
+			}
+			if err != nil || string(extracted) != content {
+				t.Errorf("%v: got %v content %q (%v), expected %q", compression, name, extracted, err, content)
+			}
+		}
+	}
+}
+
+func TestIncompleteFile(t *testing.T) {
+	writer, err := NewWriter(ioutil.Discard, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := writer.Create("data.bin", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("data"))
+	if err = file.Close(); err == nil {
+		t.Errorf("got no error for incomplete file")
+	}
+	if _, err = writer.Create("next.bin", 1); err == nil {
+		t.Errorf("got no error for file after incomplete file")
+	}
+	if err = writer.Close(); err == nil {
+		t.Errorf("got no error for archive with incomplete file")
+	}
+}
+
+func TestIsArchiveName(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"daily.tar":         true,
+		"daily.tar.zst":     true,
+		"daily.TGZ":         true,
+		"daily.tar.lz4.enc": true,
+		"daily":             false,
+		"daily.tar.tmp":     false,
+		"daily.zip":         false,
+	} {
+		if IsArchiveName(name) != expected {
+			t.Errorf("%v: got %v, expected %v", name, !expected, expected)
+		}
+	}
+}
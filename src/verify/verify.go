@@ -0,0 +1,159 @@
+package verify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fileutils"
+	"fmt"
+	"io"
+	logs "logging"
+	"manifest"
+	parts "partutils"
+	"path"
+	"storage"
+	"strings"
+)
+
+type VerifyBackup struct {
+	Source storage.Storage
+	Result []string
+}
+
+// Verify backup files with manifest checksums and parts with clickhouse checksums.txt
+func (vb *VerifyBackup) Run(ctx context.Context) error {
+
+	backupManifest, err := manifest.Read(vb.Source)
+	if err != nil {
+		return err
+	}
+
+	logs.Info.Printf("verify backup created at %v", backupManifest.StartTime)
+	if backupManifest.Incomplete != "" {
+		vb.fail("backup is incomplete, %v", backupManifest.Incomplete)
+	}
+
+	expectedFiles := make(map[string]bool)
+	for _, database := range backupManifest.Databases {
+		for _, file := range database.Metadata {
+			expectedFiles[file.Path] = true
+			vb.verifyFile(file, nil)
+		}
+		for _, table := range database.Tables {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			for _, part := range table.Parts {
+				checksums := vb.verifyPart(path.Join(
+					"partitions",
+					fileutils.EscapeForFileName(database.Name),
+					fileutils.EscapeForFileName(table.Name),
+					part.Name), part)
+				for _, file := range part.Files {
+					expectedFiles[file.Path] = true
+					vb.verifyFile(file, checksums[file.Path])
+				}
+			}
+		}
+	}
+
+	// look for files missing in manifest
+	for _, directory := range []string{"partitions/", "metadata/"} {
+		files, err := vb.Source.List(directory)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !expectedFiles[file.Name] && !strings.Contains(file.Name, "/detached/") {
+				vb.fail("%v: not found in %v", file.Name, manifest.FileName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Add problem to result
+func (vb *VerifyBackup) fail(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	logs.Error.Println(problem)
+	vb.Result = append(vb.Result, problem)
+}
+
+// Compare file size and checksum with manifest, part files are compared with hash of clickhouse checksums.txt too
+func (vb *VerifyBackup) verifyFile(file manifest.File, checksum *parts.PartFileChecksum) {
+	fileInfo, err := vb.Source.Stat(file.Path)
+	if err != nil {
+		vb.fail("%v: %v", file.Path, err)
+		return
+	}
+	if fileInfo.Size != file.Size {
+		vb.fail("%v: size %v, expected %v", file.Path, fileInfo.Size, file.Size)
+		return
+	}
+	if file.SHA256 == "" {
+		vb.fail("%v: no checksum in %v", file.Path, manifest.FileName)
+		return
+	}
+
+	reader, err := vb.Source.Get(file.Path)
+	if err != nil {
+		vb.fail("%v: %v", file.Path, err)
+		return
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	fileHash := &parts.FileHash{}
+	if _, err = io.Copy(io.MultiWriter(hash, fileHash), reader); err != nil {
+		vb.fail("%v: %v", file.Path, err)
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		vb.fail("%v: checksum mismatch", file.Path)
+	}
+	// file broken before backup has manifest checksum of broken content
+	if checksum != nil && fileHash.Sum() != checksum.FileHash {
+		vb.fail("%v: hash mismatch with %v", file.Path, parts.ChecksumsFileName)
+	}
+}
+
+// Compare part files with clickhouse checksums.txt, every file of checksums.txt must be in manifest
+// with the same size, returned checksums of files by path are compared with file content by verifyFile
+func (vb *VerifyBackup) verifyPart(partPath string, part manifest.Part) map[string]*parts.PartFileChecksum {
+	result := make(map[string]*parts.PartFileChecksum)
+
+	content, err := storage.GetBytes(vb.Source, path.Join(partPath, parts.ChecksumsFileName))
+	if err != nil {
+		vb.fail("%v: can't read %v, %v", partPath, parts.ChecksumsFileName, err)
+		return result
+	}
+	checksums, err := parts.ParsePartChecksums(content)
+	if err != nil {
+		vb.fail("%v: can't read %v, %v", partPath, parts.ChecksumsFileName, err)
+		return result
+	}
+
+	manifestFiles := make(map[string]manifest.File)
+	for _, file := range part.Files {
+		manifestFiles[file.Path] = file
+	}
+	for i, checksum := range checksums {
+		// projections are directories with own checksums.txt
+		if strings.HasSuffix(checksum.FileName, ".proj") {
+			continue
+		}
+		filePath := path.Join(partPath, checksum.FileName)
+		file, ok := manifestFiles[filePath]
+		if !ok {
+			vb.fail("%v: not found in %v", filePath, manifest.FileName)
+			continue
+		}
+		if uint64(file.Size) != checksum.FileSize {
+			vb.fail("%v: size %v, expected %v by %v", filePath, file.Size, checksum.FileSize, parts.ChecksumsFileName)
+			continue
+		}
+		result[filePath] = &checksums[i]
+	}
+	return result
+}
@@ -0,0 +1,122 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	logs "logging"
+	"manifest"
+	"os"
+	parts "partutils"
+	"storage"
+	"strings"
+	"testing"
+)
+
+const testPart = "partitions/my%2Ddb/events%2Ev2/1_1_1_0/"
+
+// Write backup of my-db.events.v2 table with one part to temporary directory
+func testBackup(t *testing.T, checksums string) *storage.Local {
+	directory, err := ioutil.TempDir("", "verify_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &storage.Recorder{Storage: &storage.Local{Directory: directory}}
+	for name, content := range map[string]string{
+		"metadata/my%2Ddb/events%2Ev2.sql": "CREATE TABLE events",
+		testPart + "checksums.txt":         checksums,
+		testPart + "data.bin":              "data",
+	} {
+		if err = storage.PutBytes(recorder, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backupManifest := manifest.New("test", "", "")
+	backupManifest.AddTables([]parts.TableDescribe{{DatabaseName: "my-db", TableName: "events.v2", Engine: "MergeTree"}})
+	backupManifest.CollectFiles(recorder)
+	if err = backupManifest.Write(recorder.Storage); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Storage.(*storage.Local)
+}
+
+// Text checksums.txt with sizes and hashes of files content
+func testChecksums(files map[string]string) string {
+	var result strings.Builder
+	fmt.Fprintf(&result, "checksums format version: 2\n%v files:\n", len(files))
+	for name, content := range files {
+		fileHash := &parts.FileHash{}
+		fileHash.Write([]byte(content))
+		hash := fileHash.Sum()
+		fmt.Fprintf(&result, "%v\n\tsize: %v\n\thash: %v %v\n\tcompressed: 0\n", name, len(content), hash.Lower64(), hash.Higher64())
+	}
+	return result.String()
+}
+
+func TestVerifyBackup(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	backup := testBackup(t, testChecksums(map[string]string{"data.bin": "data"}))
+	defer os.RemoveAll(backup.Directory)
+
+	cmdVerifyBackup := VerifyBackup{Source: backup}
+	if err := cmdVerifyBackup.Run(context.Background()); err != nil || len(cmdVerifyBackup.Result) > 0 {
+		t.Fatalf("backup is broken: %v (%v)", cmdVerifyBackup.Result, err)
+	}
+
+	// content is changed, size is the same
+	if err := ioutil.WriteFile(backup.Directory+"/"+testPart+"data.bin", []byte("DATA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmdVerifyBackup = VerifyBackup{Source: backup}
+	if err := cmdVerifyBackup.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[" + testPart + "data.bin: checksum mismatch " + testPart + "data.bin: hash mismatch with checksums.txt]"
+	if fmt.Sprint(cmdVerifyBackup.Result) != expected {
+		t.Errorf("got problems %v, expected %v", cmdVerifyBackup.Result, expected)
+	}
+}
+
+func TestVerifyPartHashes(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	// part was broken before backup, content has the same size
+	backup := testBackup(t, testChecksums(map[string]string{"data.bin": "DATA"}))
+	defer os.RemoveAll(backup.Directory)
+
+	cmdVerifyBackup := VerifyBackup{Source: backup}
+	if err := cmdVerifyBackup.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[" + testPart + "data.bin: hash mismatch with checksums.txt]"
+	if fmt.Sprint(cmdVerifyBackup.Result) != expected {
+		t.Errorf("got problems %v, expected %v", cmdVerifyBackup.Result, expected)
+	}
+}
+
+func TestVerifyPartChecksums(t *testing.T) {
+	logs.Init(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+
+	backup := testBackup(t, testChecksums(map[string]string{"data.bin": "data1", "data.mrk2": "0123456789"}))
+	defer os.RemoveAll(backup.Directory)
+
+	cmdVerifyBackup := VerifyBackup{Source: backup}
+	if err := cmdVerifyBackup.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		testPart + "data.bin: size 4, expected 5 by checksums.txt": true,
+		testPart + "data.mrk2: not found in manifest.json":         true,
+	}
+	if len(cmdVerifyBackup.Result) != len(expected) {
+		t.Fatalf("got problems %v, expected %v", cmdVerifyBackup.Result, expected)
+	}
+	for _, problem := range cmdVerifyBackup.Result {
+		if !expected[problem] {
+			t.Errorf("unexpected problem %v", problem)
+		}
+	}
+}